@@ -0,0 +1,101 @@
+/*
+Command layoutgen writes OPC-style JSON layout files for some common fixtures.
+
+For example, this recreates layouts/circle_r1_50x.json:
+
+	layoutgen --shape circle --radius 1 --count 50 > layouts/circle_r1_50x.json
+
+and this recreates layouts/circle_r1_160x2_vertical.json, two copies of a standing circle:
+
+	layoutgen --shape circle --radius 1 --count 160 --vertical --repeat 2 > layouts/circle_r1_160x2_vertical.json
+*/
+package main
+
+import (
+	"fmt"
+	"github.com/droundy/goopt"
+	"github.com/longears/pixelslinger/opc"
+	"os"
+	"strconv"
+)
+
+const (
+	SHAPE_CIRCLE   = "circle"
+	SHAPE_CYLINDER = "cylinder"
+	SHAPE_HELIX    = "helix"
+	SHAPE_GRID     = "grid"
+)
+
+// these are pointers to the actual values from the command line parser
+var SHAPE = goopt.Alternatives([]string{"-s", "--shape"}, []string{SHAPE_CIRCLE, SHAPE_CYLINDER, SHAPE_HELIX, SHAPE_GRID}, "shape of the fixture")
+var RADIUS = goopt.String([]string{"-r", "--radius"}, "1", "radius (circle, cylinder, helix)")
+var HEIGHT = goopt.String([]string{"--height"}, "2", "height (cylinder, helix, grid)")
+var WIDTH = goopt.String([]string{"--width"}, "2", "width (grid)")
+var COUNT = goopt.Int([]string{"-c", "--count"}, 160, "number of pixels (circle, helix), pixels around each ring (cylinder), or columns (grid)")
+var ROWS = goopt.Int([]string{"--rows"}, 10, "number of rings (cylinder) or rows (grid)")
+var TURNS = goopt.String([]string{"--turns"}, "5", "number of turns (helix)")
+var WIRING = goopt.Alternatives([]string{"-w", "--wiring"}, []string{opc.WIRING_ROWS, opc.WIRING_COLUMNS, opc.WIRING_ZIGZAG_ROWS, opc.WIRING_ZIGZAG_COLUMNS}, "wiring order (grid; cylinder understands rows and zigzag-rows)")
+var VERTICAL = goopt.Flag([]string{"--vertical"}, []string{}, "stand the circle up in the x-z plane", "")
+var REVERSE = goopt.Flag([]string{"--reverse"}, []string{}, "reverse the wiring order", "")
+var REPEAT = goopt.Int([]string{"--repeat"}, 1, "number of copies of the pixels, one after another")
+var OUTPUT = goopt.String([]string{"-o", "--output"}, "-", "file to write the layout to, or - for stdout")
+
+// Parse a float flag.  If invalid, show help and quit.
+func parseFloatFlag(name, value string) float64 {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		quit(fmt.Sprintf("Error: bad value for --%s: %s", name, value))
+	}
+	return f
+}
+
+func quit(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	fmt.Fprintln(os.Stderr, goopt.Usage())
+	os.Exit(1)
+}
+
+func main() {
+	goopt.Parse(nil)
+
+	radius := parseFloatFlag("radius", *RADIUS)
+	height := parseFloatFlag("height", *HEIGHT)
+	width := parseFloatFlag("width", *WIDTH)
+	turns := parseFloatFlag("turns", *TURNS)
+	if *COUNT < 1 || *ROWS < 1 || *REPEAT < 1 {
+		quit("Error: --count, --rows and --repeat must be at least 1")
+	}
+
+	var layout *opc.Layout
+	switch *SHAPE {
+	case SHAPE_CIRCLE:
+		layout = opc.MakeCircleLayout(radius, *COUNT, *VERTICAL)
+	case SHAPE_CYLINDER:
+		if *WIRING != opc.WIRING_ROWS && *WIRING != opc.WIRING_ZIGZAG_ROWS {
+			quit(fmt.Sprintf("Error: cylinders can only be wired in %s or %s, not %s", opc.WIRING_ROWS, opc.WIRING_ZIGZAG_ROWS, *WIRING))
+		}
+		layout = opc.MakeCylinderLayout(radius, height, *COUNT, *ROWS, *WIRING == opc.WIRING_ZIGZAG_ROWS)
+	case SHAPE_HELIX:
+		layout = opc.MakeHelixLayout(radius, height, *COUNT, turns)
+	case SHAPE_GRID:
+		layout = opc.MakeGridLayout(width, height, *COUNT, *ROWS, *WIRING)
+	}
+	if *REVERSE {
+		layout.Reverse()
+	}
+	layout.Repeat(*REPEAT)
+
+	out := os.Stdout
+	if *OUTPUT != "-" {
+		file, err := os.Create(*OUTPUT)
+		if err != nil {
+			quit(fmt.Sprintf("Error: %v", err))
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := layout.WriteJson(out); err != nil {
+		quit(fmt.Sprintf("Error: %v", err))
+	}
+	fmt.Fprintf(os.Stderr, "[layoutgen] wrote %v pixels\n", len(layout.Pixels))
+}
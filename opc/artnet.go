@@ -0,0 +1,194 @@
+package opc
+
+// Art-Net
+//   Send frames to Art-Net nodes as DMX over UDP.
+//   Each DMX universe holds 512 channels, which is 170 pixels, so the frame is split across
+//   as many consecutive universes as it takes.  Each universe goes out as an ArtDMX packet,
+//   optionally followed by one ArtSync packet per frame which tells the nodes to show all their
+//   universes at the same moment.
+//   The destination is a URL like "artnet://10.0.0.5?universe=0&sync=true".  Add "node=" settings
+//   to send the same packets to more nodes, like "artnet://10.0.0.5?node=10.0.0.6&node=10.0.0.7".
+//   See http://artisticlicence.com/WebSiteMaster/User%20Guides/art-net.pdf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const ARTNET_SCHEME = "artnet"
+const ARTNET_PORT = "6454"
+
+// DMX universes
+const (
+	DMX_UNIVERSE_SIZE   = 512 // channels
+	PIXELS_PER_UNIVERSE = DMX_UNIVERSE_SIZE / 3
+)
+
+// Art-Net packets
+const (
+	ARTNET_ID                      = "Art-Net\x00"
+	ARTNET_OP_DMX           uint16 = 0x5000
+	ARTNET_OP_SYNC          uint16 = 0x5200
+	ARTNET_VERSION                 = 14
+	ARTNET_DMX_HEADER_SIZE         = 18     // bytes before the first channel value
+	ARTNET_MAX_PORT_ADDRESS        = 0x7fff // the universe is 15 bits
+)
+
+// Where and how to send Art-Net.
+type ArtnetSettings struct {
+	Addresses []string // host:port of each node, or of a broadcast address; each gets every packet
+	Universe  int      // universe of the first pixel
+	Sync      bool     // send ArtSync after each frame
+}
+
+// Parse a destination URL like "artnet://10.0.0.5:6454?universe=0&sync=true&node=10.0.0.6".
+// Each "node" setting adds another host[:port] to send to, after the one before the "?".
+// The ports default to ARTNET_PORT, the universe to 0 and sync to false.
+func ParseArtnetUrl(rawurl string) (ArtnetSettings, error) {
+	settings := ArtnetSettings{}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return settings, err
+	}
+	if u.Scheme != ARTNET_SCHEME || u.Hostname() == "" {
+		return settings, fmt.Errorf("%q should look like %s://host[:port][?universe=0&sync=true&node=host[:port]]", rawurl, ARTNET_SCHEME)
+	}
+	port := u.Port()
+	if port == "" {
+		port = ARTNET_PORT
+	}
+	settings.Addresses = []string{net.JoinHostPort(u.Hostname(), port)}
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "node":
+			for _, node := range values {
+				address, err := artnetNodeAddress(node)
+				if err != nil {
+					return settings, fmt.Errorf("%q: %v", rawurl, err)
+				}
+				settings.Addresses = append(settings.Addresses, address)
+			}
+		case "universe":
+			if settings.Universe, err = strconv.Atoi(value); err != nil || settings.Universe < 0 || settings.Universe > ARTNET_MAX_PORT_ADDRESS {
+				return settings, fmt.Errorf("%q: universe should be between 0 and %v", rawurl, ARTNET_MAX_PORT_ADDRESS)
+			}
+		case "sync":
+			if settings.Sync, err = strconv.ParseBool(value); err != nil {
+				return settings, fmt.Errorf("%q: sync should be true or false", rawurl)
+			}
+		default:
+			return settings, fmt.Errorf("%q: unknown setting %q", rawurl, key)
+		}
+	}
+	return settings, nil
+}
+
+// Turn "host" or "host:port" into host:port, with the port defaulting to ARTNET_PORT.
+func artnetNodeAddress(node string) (string, error) {
+	if host, port, err := net.SplitHostPort(node); err == nil {
+		if host == "" || port == "" {
+			return "", fmt.Errorf("node %q should look like host[:port]", node)
+		}
+		return node, nil
+	}
+	if node == "" || strings.Contains(node, ":") {
+		return "", fmt.Errorf("node %q should look like host[:port]", node)
+	}
+	return net.JoinHostPort(node, ARTNET_PORT), nil
+}
+
+// Split the bytes into DMX universes of whole pixels.
+func splitUniverses(bytes []byte) [][]byte {
+	universes := make([][]byte, 0)
+	for ii := 0; ii < len(bytes); ii += PIXELS_PER_UNIVERSE * 3 {
+		endIndex := ii + PIXELS_PER_UNIVERSE*3
+		if endIndex > len(bytes) {
+			endIndex = len(bytes)
+		}
+		universes = append(universes, bytes[ii:endIndex])
+	}
+	return universes
+}
+
+// Return an error if a frame of nPixels, starting at universe first, would need universes past last.
+func checkUniverseRange(first int, nPixels int, last int) error {
+	nUniverses := (nPixels + PIXELS_PER_UNIVERSE - 1) / PIXELS_PER_UNIVERSE
+	if first+nUniverses-1 > last {
+		return fmt.Errorf("%v pixels need universes %v to %v, but the last universe is %v", nPixels, first, first+nUniverses-1, last)
+	}
+	return nil
+}
+
+func makeArtnetHeader(opCode uint16) []byte {
+	header := []byte(ARTNET_ID)
+	// the op code is little-endian and the version is big-endian
+	return append(header, byte(opCode&0xff), byte(opCode>>8), 0, ARTNET_VERSION)
+}
+
+// Make an ArtDMX packet with the channel values for one universe.
+func makeArtDmxPacket(sequence byte, universe int, data []byte) []byte {
+	packet := makeArtnetHeader(ARTNET_OP_DMX)
+	length := len(data)
+	if length%2 == 1 {
+		// the length has to be even
+		length++
+	}
+	packet = append(packet,
+		sequence,
+		0, // physical input port
+		byte(universe&0xff),
+		byte(universe>>8&0x7f),
+		byte(length>>8),
+		byte(length&0xff))
+	packet = append(packet, data...)
+	for len(packet) < ARTNET_DMX_HEADER_SIZE+length {
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+// Make an ArtSync packet.
+func makeArtSyncPacket() []byte {
+	return append(makeArtnetHeader(ARTNET_OP_SYNC), 0, 0)
+}
+
+// Return a ByteThread which sends the bytes to each of the Art-Net nodes as DMX, one universe per
+// 170 pixels, starting at settings.Universe.
+// If the frames need universes past ARTNET_MAX_PORT_ADDRESS, exit the whole program with exit
+// status 1.
+func MakeSendToArtnetThread(settings ArtnetSettings, pixelFormats []PixelFormat) ByteThread {
+	checkFrame := func(nPixels int) error {
+		return checkUniverseRange(settings.Universe, nPixels, ARTNET_MAX_PORT_ADDRESS)
+	}
+	sequence := byte(0)
+	// send a packet to every node
+	sendToAll := func(sender *udpSender, packet []byte) error {
+		for _, address := range settings.Addresses {
+			if err := sender.send(packet, address); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	description := strings.Join(settings.Addresses, ", ")
+	return makeUdpOutputThread("SendToArtnetThread", description, pixelFormats, checkFrame, func(sender *udpSender, dmxBytes []byte) error {
+		// sequence numbers go from 1 to 255; 0 means we don't use them
+		sequence++
+		if sequence == 0 {
+			sequence = 1
+		}
+		for uu, data := range splitUniverses(dmxBytes) {
+			if err := sendToAll(sender, makeArtDmxPacket(sequence, settings.Universe+uu, data)); err != nil {
+				return err
+			}
+		}
+		if settings.Sync {
+			return sendToAll(sender, makeArtSyncPacket())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,71 @@
+package opc
+
+// Frame clock
+//   Patterns and effects don't read the wall clock themselves.  Instead the main loop ticks a
+//   FrameClock once per frame and hands the result out with SetFrameContext, and they ask
+//   CurrentFrame what time it is.  Normally the clock follows the wall clock, but the render
+//   command and the tests use a fixed-step clock, so the output is the same however fast the
+//   computer is, and can be slowed down or rendered offline.
+
+import (
+	"time"
+)
+
+// The wall clock is shown to patterns minus this many seconds, which keeps the numbers small
+// enough for their float math.
+const PATTERN_TIME_OFFSET = 9.4e8
+
+// What patterns need to know about the frame they're computing.
+type FrameContext struct {
+	Time  float64 // show time in seconds
+	Delta float64 // seconds of show time since the previous frame, or 0 for the first frame
+	Frame int     // counts up from 0
+}
+
+// Produces one FrameContext per frame.
+type FrameClock struct {
+	now   func(frame int) float64
+	frame int
+	last  float64
+}
+
+// Return a clock which follows the wall clock.
+func MakeRealTimeClock() *FrameClock {
+	return &FrameClock{now: func(frame int) float64 {
+		return float64(time.Now().UnixNano())/1.0e9 - PATTERN_TIME_OFFSET
+	}}
+}
+
+// Return a clock which starts at startTime seconds and moves on exactly 1/fps seconds each
+// frame, however long the frames take to compute.
+func MakeFixedStepClock(startTime float64, fps float64) *FrameClock {
+	return &FrameClock{now: func(frame int) float64 {
+		return startTime + float64(frame)/fps
+	}}
+}
+
+// Move on to the next frame and return its context.
+func (clock *FrameClock) Tick() FrameContext {
+	ctx := FrameContext{Time: clock.now(clock.frame), Frame: clock.frame}
+	if clock.frame > 0 {
+		ctx.Delta = ctx.Time - clock.last
+	}
+	clock.last = ctx.Time
+	clock.frame++
+	return ctx
+}
+
+// The context of the frame being computed.
+var currentFrame FrameContext
+
+// Set the context of the next frame.  Call this before sending the frame's bytes down the
+// pipeline; the channel send makes it visible to the threads which compute that frame.
+func SetFrameContext(ctx FrameContext) {
+	currentFrame = ctx
+}
+
+// Return the context of the frame being computed.  Only meaningful while a frame is being
+// filled in; before the first SetFrameContext it's all zeros.
+func CurrentFrame() FrameContext {
+	return currentFrame
+}
@@ -0,0 +1,82 @@
+package opc
+
+// DDP
+//   Send frames with the Distributed Display Protocol, which WLED and xLights controllers speak.
+//   The whole frame is one stream of bytes, sent in UDP packets which each say where in the
+//   stream their data goes.  The last packet of a frame has the push flag set, which tells the
+//   controller to show the frame.
+//   The destination is a URL like "ddp://10.0.0.5".
+//   See http://www.3waylabs.com/ddp/
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+const DDP_SCHEME = "ddp"
+const DDP_PORT = "4048"
+
+// DDP packets
+const (
+	DDP_HEADER_SIZE     = 10
+	DDP_MAX_DATA_SIZE   = 1440 // bytes, or 480 pixels, which fits in a 1500 byte Ethernet packet
+	DDP_FLAGS_VERSION_1 = 0x40
+	DDP_FLAGS_PUSH      = 0x01
+	DDP_TYPE_RGB_8_BIT  = 0x0b
+	DDP_ID_DISPLAY      = 1  // the controller's default output
+	DDP_MAX_SEQUENCE    = 15 // sequence numbers go from 1 to 15; 0 means we don't use them
+)
+
+// Parse a destination URL like "ddp://10.0.0.5:4048" into the address to send to.
+// The port defaults to DDP_PORT.
+func ParseDDPUrl(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != DDP_SCHEME || u.Hostname() == "" || u.RawQuery != "" {
+		return "", fmt.Errorf("%q should look like %s://host[:port]", rawurl, DDP_SCHEME)
+	}
+	port := u.Port()
+	if port == "" {
+		port = DDP_PORT
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Make a DDP packet with the data which goes at the given offset in the frame.
+func makeDDPPacket(sequence byte, offset int, data []byte, push bool) []byte {
+	packet := make([]byte, DDP_HEADER_SIZE, DDP_HEADER_SIZE+len(data))
+	packet[0] = DDP_FLAGS_VERSION_1
+	if push {
+		packet[0] |= DDP_FLAGS_PUSH
+	}
+	packet[1] = sequence
+	packet[2] = DDP_TYPE_RGB_8_BIT
+	packet[3] = DDP_ID_DISPLAY
+	binary.BigEndian.PutUint32(packet[4:], uint32(offset))
+	binary.BigEndian.PutUint16(packet[8:], uint16(len(data)))
+	return append(packet, data...)
+}
+
+// Return a ByteThread which sends the bytes to a DDP controller at ipPort, split into packets
+// of up to DDP_MAX_DATA_SIZE bytes.
+func MakeSendToDDPThread(ipPort string, pixelFormats []PixelFormat) ByteThread {
+	sequence := byte(0)
+	return makeUdpOutputThread("SendToDDPThread", ipPort, pixelFormats, nil, func(sender *udpSender, ddpBytes []byte) error {
+		for offset := 0; offset < len(ddpBytes); offset += DDP_MAX_DATA_SIZE {
+			endIndex := offset + DDP_MAX_DATA_SIZE
+			if endIndex > len(ddpBytes) {
+				endIndex = len(ddpBytes)
+			}
+			sequence = sequence%DDP_MAX_SEQUENCE + 1
+			push := endIndex == len(ddpBytes)
+			if err := sender.send(makeDDPPacket(sequence, offset, ddpBytes[offset:endIndex], push), ipPort); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
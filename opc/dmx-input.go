@@ -0,0 +1,383 @@
+package opc
+
+// DMX input
+//   Sources which listen for Art-Net or sACN from a lighting console and turn the universes back
+//   into frames, so the effects (and the MIDI controls of the fader) can be layered on top.
+//   Each universe fills a range of pixels given by a universe map.  By default the universes are
+//   consecutive, 170 pixels each, starting from a chosen universe, which matches what a console
+//   patched the same way as our Art-Net and sACN outputs would send.
+//   The source is a URL like "artnet://?universe=0" or "sacn://?universe=1&multicast=true".
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The biggest packet either protocol sends
+const DMX_MAX_PACKET_SIZE = SACN_DATA_HEADER_SIZE + DMX_UNIVERSE_SIZE
+
+// Which range of the frame each universe writes into.
+type UniverseMap map[int]PixelRange
+
+// Where and how to listen for DMX.
+type DmxSourceSettings struct {
+	Scheme    string // ARTNET_SCHEME or SACN_SCHEME
+	Address   string // ip:port to listen on
+	Universe  int    // the first universe when there's no universe map
+	Multicast bool   // for sACN, join the multicast group of each universe in the map, on the interface with Address's ip
+}
+
+// Return the port and the range of universes for the scheme, which is ARTNET_SCHEME or
+// SACN_SCHEME.  Return false if it's neither.
+func dmxSchemeDefaults(scheme string) (port string, minUniverse int, maxUniverse int, ok bool) {
+	switch scheme {
+	case ARTNET_SCHEME:
+		return ARTNET_PORT, 0, ARTNET_MAX_PORT_ADDRESS, true
+	case SACN_SCHEME:
+		return SACN_PORT, SACN_MIN_UNIVERSE, SACN_MAX_UNIVERSE, true
+	}
+	return "", 0, 0, false
+}
+
+// Parse a source URL like "artnet://[ip][:port][?universe=0]" or
+// "sacn://[ip][:port][?universe=1&multicast=true]".
+// Leave out the ip to listen on all interfaces.  With multicast, the ip picks the interface to
+// join the groups on instead, and has to be an IPv4 address.  The port defaults to ARTNET_PORT or
+// SACN_PORT, and the universe to the first one the protocol allows.
+func ParseDmxSourceUrl(rawurl string) (DmxSourceSettings, error) {
+	settings := DmxSourceSettings{}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return settings, err
+	}
+	port, minUniverse, maxUniverse, ok := dmxSchemeDefaults(u.Scheme)
+	if !ok {
+		return settings, fmt.Errorf("%q should look like %s://[ip][:port][?universe=0] or %s://[ip][:port][?universe=1&multicast=true]", rawurl, ARTNET_SCHEME, SACN_SCHEME)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	settings.Scheme = u.Scheme
+	settings.Address = net.JoinHostPort(u.Hostname(), port)
+	settings.Universe = minUniverse
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch {
+		case key == "universe":
+			if settings.Universe, err = strconv.Atoi(value); err != nil || settings.Universe < minUniverse || settings.Universe > maxUniverse {
+				return settings, fmt.Errorf("%q: universe should be between %v and %v", rawurl, minUniverse, maxUniverse)
+			}
+		case key == "multicast" && u.Scheme == SACN_SCHEME:
+			if settings.Multicast, err = strconv.ParseBool(value); err != nil {
+				return settings, fmt.Errorf("%q: multicast should be true or false", rawurl)
+			}
+		default:
+			return settings, fmt.Errorf("%q: unknown setting %q", rawurl, key)
+		}
+	}
+	if settings.Multicast && u.Hostname() != "" {
+		if ip := net.ParseIP(u.Hostname()); ip == nil || ip.To4() == nil {
+			return settings, fmt.Errorf("%q: with multicast, the host should be the IPv4 address of an interface to listen on", rawurl)
+		}
+	}
+	return settings, nil
+}
+
+// Read a universe map from a JSON file which lives alongside the layout file, like this:
+//
+//	[
+//	  {"universe": 1, "first": 0, "count": 170},
+//	  {"universe": 2, "first": 170, "count": 150}
+//	]
+//
+// scheme is ARTNET_SCHEME or SACN_SCHEME, whichever the universes will arrive over.
+// Return an error if the file can't be parsed, any universe isn't one the scheme allows, any range
+// has more pixels than fit in a universe, or any range falls outside of nPixels.
+func ReadUniverseMap(fn string, scheme string, nPixels int) (UniverseMap, error) {
+	_, minUniverse, maxUniverse, ok := dmxSchemeDefaults(scheme)
+	if !ok {
+		return nil, fmt.Errorf("unknown DMX scheme %q", scheme)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Universe int `json:"universe"`
+		PixelRange
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	universeMap := make(UniverseMap)
+	for _, entry := range entries {
+		if entry.Universe < minUniverse || entry.Universe > maxUniverse {
+			return nil, fmt.Errorf("%s: %s universe %v should be between %v and %v", fn, scheme, entry.Universe, minUniverse, maxUniverse)
+		}
+		if _, ok := universeMap[entry.Universe]; ok {
+			return nil, fmt.Errorf("%s: universe %v appears more than once", fn, entry.Universe)
+		}
+		if entry.Count > PIXELS_PER_UNIVERSE {
+			return nil, fmt.Errorf("%s: universe %v has %v pixels but only %v fit", fn, entry.Universe, entry.Count, PIXELS_PER_UNIVERSE)
+		}
+		if entry.First < 0 || entry.Count < 1 || entry.First+entry.Count > nPixels {
+			return nil, fmt.Errorf("%s: universe %v covers pixels %v to %v but the layout only has %v pixels",
+				fn, entry.Universe, entry.First, entry.First+entry.Count-1, nPixels)
+		}
+		universeMap[entry.Universe] = entry.PixelRange
+	}
+	fmt.Printf("[opc.ReadUniverseMap] Read %v universes from %s\n", len(universeMap), fn)
+	return universeMap, nil
+}
+
+// Make a universe map which covers nPixels with consecutive universes of 170 pixels each,
+// starting at firstUniverse.
+func DefaultUniverseMap(firstUniverse int, nPixels int) UniverseMap {
+	universeMap := make(UniverseMap)
+	for first := 0; first < nPixels; first += PIXELS_PER_UNIVERSE {
+		count := PIXELS_PER_UNIVERSE
+		if first+count > nPixels {
+			count = nPixels - first
+		}
+		universeMap[firstUniverse+first/PIXELS_PER_UNIVERSE] = PixelRange{First: first, Count: count}
+	}
+	return universeMap
+}
+
+// Channel values received for one universe.
+type DmxMessage struct {
+	Universe int
+	Data     []byte
+	Client   string // address of the sender
+}
+
+// Parse an ArtDMX packet.  Return false if it isn't one.
+func parseArtDmxPacket(packet []byte) (universe int, data []byte, ok bool) {
+	if len(packet) < ARTNET_DMX_HEADER_SIZE || string(packet[:len(ARTNET_ID)]) != ARTNET_ID ||
+		binary.LittleEndian.Uint16(packet[len(ARTNET_ID):]) != ARTNET_OP_DMX {
+		return 0, nil, false
+	}
+	universe = int(binary.LittleEndian.Uint16(packet[14:]) & ARTNET_MAX_PORT_ADDRESS)
+	length := int(binary.BigEndian.Uint16(packet[16:]))
+	data = packet[ARTNET_DMX_HEADER_SIZE:]
+	if len(data) > length {
+		data = data[:length]
+	}
+	return universe, data, true
+}
+
+// Parse an E1.31 data packet.  Return false if it isn't one, or if it's preview data or the
+// last packet of a stream, which shouldn't be shown.
+func parseSacnDataPacket(packet []byte) (universe int, data []byte, ok bool) {
+	if len(packet) < SACN_DATA_HEADER_SIZE || string(packet[4:16]) != SACN_ACN_ID ||
+		binary.BigEndian.Uint32(packet[18:]) != SACN_VECTOR_ROOT_DATA ||
+		binary.BigEndian.Uint32(packet[40:]) != SACN_VECTOR_FRAMING_DATA ||
+		packet[117] != SACN_VECTOR_DMP_SET || packet[125] != 0 {
+		return 0, nil, false
+	}
+	// options: preview data, stream terminated
+	if packet[112]&0xc0 != 0 {
+		return 0, nil, false
+	}
+	universe = int(binary.BigEndian.Uint16(packet[113:]))
+	length := int(binary.BigEndian.Uint16(packet[123:])) - 1 // not counting the start code
+	data = packet[SACN_DATA_HEADER_SIZE:]
+	if length >= 0 && len(data) > length {
+		data = data[:length]
+	}
+	return universe, data, true
+}
+
+// Paint the channel values of a universe into its range of the frame.
+// Any partial pixel, and any pixels past the end of the range, are dropped.
+// Return false if the universe isn't in the map.
+func compositeDmxMessage(frame []byte, dmxMessage *DmxMessage, universeMap UniverseMap) bool {
+	pixelRange, ok := universeMap[dmxMessage.Universe]
+	if !ok {
+		return false
+	}
+	nPixels := len(dmxMessage.Data) / 3
+	if nPixels > pixelRange.Count {
+		nPixels = pixelRange.Count
+	}
+	if start := pixelRange.First * 3; start < len(frame) {
+		copy(frame[start:], dmxMessage.Data[:nPixels*3])
+	}
+	return true
+}
+
+// Read packets from the socket forever, and push the universes in them over the channel.
+// parse picks the universe and channel values out of a packet.
+func serveDmx(packetConn net.PacketConn, parse func(packet []byte) (int, []byte, bool), incomingDmxMessageChan chan *DmxMessage) error {
+	buffer := make([]byte, DMX_MAX_PACKET_SIZE)
+	for {
+		n, addr, err := packetConn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		universe, data, ok := parse(buffer[:n])
+		if !ok {
+			continue
+		}
+		incomingDmxMessageChan <- &DmxMessage{
+			Universe: universe,
+			Data:     append([]byte{}, data...),
+			Client:   addr.String(),
+		}
+	}
+}
+
+// Return the network interface which has the IPv4 address ip.
+func interfaceWithAddress(ip net.IP) (*net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for ii := range interfaces {
+		addrs, err := interfaces[ii].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return &interfaces[ii], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no network interface has the address %v", ip)
+}
+
+// Join another multicast group on a socket made by net.ListenMulticastUDP.  ifaceIP is the IPv4
+// address of the interface to join it on, or nil to let the system choose.
+func joinMulticastGroup(conn *net.UDPConn, group net.IP, ifaceIP net.IP) error {
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group.To4())
+	if ifaceIP != nil {
+		copy(mreq.Interface[:], ifaceIP.To4())
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var joinErr error
+	err = rawConn.Control(func(fd uintptr) {
+		joinErr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return joinErr
+}
+
+// Open one socket on the port which has joined the multicast group of each universe.  If host
+// isn't empty, join them on the interface with that IPv4 address.
+func listenSacnMulticast(host string, port string, universes []int) (*net.UDPConn, error) {
+	var ifi *net.Interface
+	var ifaceIP net.IP
+	if host != "" {
+		ifaceIP = net.ParseIP(host)
+		var err error
+		if ifi, err = interfaceWithAddress(ifaceIP); err != nil {
+			return nil, err
+		}
+	}
+	groups := make([]*net.UDPAddr, len(universes))
+	for ii, universe := range universes {
+		group, _, _ := net.SplitHostPort(sacnMulticastAddress(universe))
+		groupAddr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(group, port))
+		if err != nil {
+			return nil, err
+		}
+		groups[ii] = groupAddr
+	}
+	// this binds to every address on the port, and joins the first group
+	conn, err := net.ListenMulticastUDP("udp4", ifi, groups[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, groupAddr := range groups[1:] {
+		if err := joinMulticastGroup(conn, groupAddr.IP, ifaceIP); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("joining %v: %v", groupAddr.IP, err)
+		}
+	}
+	return conn, nil
+}
+
+// Start listening for DMX according to dmxSettings, and push the universes we get over the channel.
+// For sACN with multicast, join the group of each universe in the map, on the port from
+// dmxSettings.Address.
+// Panic if we can't listen.
+func launchDmxServer(dmxSettings DmxSourceSettings, universeMap UniverseMap, incomingDmxMessageChan chan *DmxMessage) {
+	parse := parseArtDmxPacket
+	if dmxSettings.Scheme == SACN_SCHEME {
+		parse = parseSacnDataPacket
+	}
+
+	var packetConn net.PacketConn
+	if dmxSettings.Scheme != SACN_SCHEME || !dmxSettings.Multicast {
+		fmt.Printf("[opc] %s server thread is listening on %v\n", dmxSettings.Scheme, dmxSettings.Address)
+		var err error
+		if packetConn, err = net.ListenPacket("udp", dmxSettings.Address); err != nil {
+			panic(err)
+		}
+	} else {
+		host, port, err := net.SplitHostPort(dmxSettings.Address)
+		if err != nil {
+			panic(err)
+		}
+		universes := make([]int, 0, len(universeMap))
+		for universe := range universeMap {
+			universes = append(universes, universe)
+		}
+		sort.Ints(universes)
+		fmt.Printf("[opc] %s server thread is listening on port %v for the multicast groups of universes %v\n", dmxSettings.Scheme, port, universes)
+		// one socket hears every group, and each packet is routed by the universe inside it
+		if packetConn, err = listenSacnMulticast(host, port, universes); err != nil {
+			panic(err)
+		}
+	}
+
+	go func() {
+		if err := serveDmx(packetConn, parse, incomingDmxMessageChan); err != nil {
+			panic(err)
+		}
+	}()
+}
+
+// Read DMX messages from the channel forever and composite them into the frame buffer.
+func receiveDmxMessagesThread(incomingDmxMessageChan chan *DmxMessage, frameBuffer *inputFrameBuffer, universeMap UniverseMap) {
+	for dmxMessage := range incomingDmxMessageChan {
+		frameBuffer.mutex.Lock()
+		if compositeDmxMessage(frameBuffer.frame, dmxMessage, universeMap) {
+			frameBuffer.lastInputTime = float64(time.Now().UnixNano()) / 1.0e9
+		}
+		frameBuffer.mutex.Unlock()
+	}
+}
+
+// Return a ByteThread function which listens for Art-Net or sACN according to dmxSettings and
+// pushes out pixels from it in the usual way ByteThreads do.
+// Each universe fills the range of pixels given to it by universeMap.  If universeMap is nil,
+// the universes are consecutive from dmxSettings.Universe and cover the whole frame.
+// Universes which aren't in the map are ignored.
+// Like MakeOpcServerThread, packets are received in the background and the frame is held or faded
+// out according to settings.InputTimeout and settings.OnTimeout; the other settings don't apply.
+func MakeDmxServerThread(dmxSettings DmxSourceSettings, universeMap UniverseMap, settings OpcSourceSettings) ByteThread {
+	return makeInputSourceThread(func(frameBuffer *inputFrameBuffer) {
+		if universeMap == nil {
+			universeMap = DefaultUniverseMap(dmxSettings.Universe, len(frameBuffer.frame)/3)
+		}
+		incomingDmxMessageChan := make(chan *DmxMessage, 0)
+		launchDmxServer(dmxSettings, universeMap, incomingDmxMessageChan)
+		receiveDmxMessagesThread(incomingDmxMessageChan, frameBuffer, universeMap)
+	}, settings)
+}
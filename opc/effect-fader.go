@@ -10,10 +10,9 @@ import (
 	"github.com/longears/pixelslinger/midi"
 	"math"
 	"math/rand"
-	"time"
 )
 
-func MakeEffectFader(locations []float64) ByteThread {
+func MakeEffectFader(layout *Layout) ByteThread {
 
 	const (
 		FLASH_DURATION_MIN = 2.0 / 40.0  // in seconds
@@ -29,8 +28,18 @@ func MakeEffectFader(locations []float64) ByteThread {
 		EYELID_BLEND = 0.25 // size of eyelid gradient relative to entire bounding box
 
 		FADE_TO_BLACK_TIME = 15.0 / 40.0 // in seconds
+
+		// layout groups lit up by the blink pads
+		BLINK_CIRCLE_GROUP = "circle"
+		BLINK_ARCH_GROUP   = "arch"
+		BLINK_BACK_GROUP   = "back"
 	)
 
+	locations := layout.Locations()
+	blinkCircleMask := layout.GroupMask(BLINK_CIRCLE_GROUP)
+	blinkArchMask := layout.GroupMask(BLINK_ARCH_GROUP)
+	blinkBackMask := layout.GroupMask(BLINK_BACK_GROUP)
+
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 
 		// get bounding box
@@ -75,7 +84,7 @@ func MakeEffectFader(locations []float64) ByteThread {
 		fadeToBlackBeginTime := 0.0
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := CurrentFrame().Time
 
 			// lightning flash pad
 			flashPad := midiState.KeyVolumes[config.FLASH_PAD]
@@ -178,17 +187,17 @@ func MakeEffectFader(locations []float64) ByteThread {
 				}
 
 				// blink regions
-				if blinkCirclePad > 0 && ii < 160*1 {
+				if blinkCirclePad > 0 && ii < len(blinkCircleMask) && blinkCircleMask[ii] {
 					r = 1
 					g = 1
 					b = 1
 				}
-				if blinkArchPad > 0 && 160*1 <= ii && ii < 160*3 {
+				if blinkArchPad > 0 && ii < len(blinkArchMask) && blinkArchMask[ii] {
 					r = 1
 					g = 1
 					b = 1
 				}
-				if blinkBackPad > 0 && 160*3 <= ii && ii < 160*5 {
+				if blinkBackPad > 0 && ii < len(blinkBackMask) && blinkBackMask[ii] {
 					r = 1
 					g = 1
 					b = 1
@@ -0,0 +1,20 @@
+package opc
+
+// Gamma effect
+//   Does nothing.  Every destination already gamma corrects the pixels on their way to the LEDs
+//   (with GAMMA), after the effects, so correcting them here too would do it twice.  It's
+//   registered anyway so that effect lists like "gamma,fader,limiter" keep working.
+
+import (
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+)
+
+func MakeEffectGamma(layout *Layout) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		fmt.Println("[opc.EffectGamma] the destinations gamma correct the pixels, so this effect passes them straight through")
+		for bytes := range bytesIn {
+			bytesOut <- bytes
+		}
+	}
+}
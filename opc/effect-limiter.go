@@ -0,0 +1,50 @@
+package opc
+
+// Limiter effect
+//   Dim the whole frame when it would draw more power than our supplies can handle.
+//   Power is roughly proportional to the LED duty cycle, which is the pixel value after
+//   gamma correction, so that's what we average.
+
+import (
+	"github.com/longears/pixelslinger/midi"
+	"math"
+)
+
+// Largest average duty cycle we allow, from 0 (black) to 1 (everything full white)
+const LIMITER_MAX_DUTY = 0.5
+
+func MakeEffectLimiter(layout *Layout) ByteThread {
+
+	// duty cycle of each byte value
+	duty := make([]float64, 256)
+	for ii := range duty {
+		duty[ii] = math.Pow(float64(ii)/255, GAMMA)
+	}
+
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			limitDuty(bytes, duty, LIMITER_MAX_DUTY)
+			bytesOut <- bytes
+		}
+	}
+}
+
+// Scale the bytes down, in place, so their average duty is at most maxDuty.
+func limitDuty(bytes []byte, duty []float64, maxDuty float64) {
+	if len(bytes) == 0 {
+		return
+	}
+	total := 0.0
+	for _, b := range bytes {
+		total += duty[b]
+	}
+	average := total / float64(len(bytes))
+	if average <= maxDuty {
+		return
+	}
+	// scaling the duty by s means scaling the byte values by s^(1/GAMMA)
+	scale := math.Pow(maxDuty/average, 1/GAMMA)
+	for ii, b := range bytes {
+		bytes[ii] = byte(float64(b) * scale)
+	}
+}
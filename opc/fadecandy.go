@@ -0,0 +1,127 @@
+package opc
+
+// FadeCandy
+//   System exclusive messages understood by FadeCandy servers.
+//   We can send these to a FadeCandy server, and we handle them ourselves when acting as an
+//   OPC server so that FadeCandy clients can treat pixelslinger as a drop-in replacement.
+//   Color correction is kept per server, in its OpcServerState.  The firmware config is only
+//   logged: we don't dither or interpolate between frames, and have no status LED to control.
+//   See https://github.com/scanlime/fadecandy/blob/master/doc/fc_protocol_opc.md
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+const FADECANDY_SYSTEM_ID uint16 = 0x0001
+
+// FadeCandy sysex IDs, which come right after the system ID
+const (
+	FADECANDY_SET_COLOR_CORRECTION uint16 = 0x0001
+	FADECANDY_SET_FIRMWARE_CONFIG  uint16 = 0x0002
+)
+
+// FadeCandy firmware configuration bits
+const (
+	FADECANDY_DISABLE_DITHERING     byte = 0x01
+	FADECANDY_DISABLE_INTERPOLATION byte = 0x02
+	FADECANDY_MANUAL_LED_CONTROL    byte = 0x04
+	FADECANDY_LED_ON                byte = 0x08
+)
+
+// Global color correction, sent as JSON.
+// Gamma is the exponent applied to incoming pixel values and Whitepoint scales the
+// red, green, and blue channels after that.
+type FadecandyColorCorrection struct {
+	Gamma      float64    `json:"gamma"`
+	Whitepoint [3]float64 `json:"whitepoint"`
+}
+
+func init() {
+	RegisterSysexHandler(FADECANDY_SYSTEM_ID, handleFadecandySysex)
+}
+
+//--------------------------------------------------------------------------------
+// SENDING
+
+// Make a message which sets the color correction of a FadeCandy server.
+func MakeFadecandyColorCorrectionMessage(colorCorrection FadecandyColorCorrection) *OpcMessage {
+	jsonBytes, err := json.Marshal(colorCorrection)
+	if err != nil {
+		panic(err)
+	}
+	return makeFadecandyMessage(FADECANDY_SET_COLOR_CORRECTION, jsonBytes)
+}
+
+// Make a message which sets the firmware configuration bits of a FadeCandy server.
+func MakeFadecandyFirmwareConfigMessage(config byte) *OpcMessage {
+	return makeFadecandyMessage(FADECANDY_SET_FIRMWARE_CONFIG, []byte{config})
+}
+
+func makeFadecandyMessage(sysexId uint16, data []byte) *OpcMessage {
+	bytes := []byte{byte(sysexId >> 8), byte(sysexId & 0xff)}
+	return MakeSysexMessage(FADECANDY_SYSTEM_ID, append(bytes, data...))
+}
+
+//--------------------------------------------------------------------------------
+// RECEIVING
+
+// A SysexHandler for messages with the FadeCandy system ID.
+func handleFadecandySysex(server *OpcServerState, opcMessage *OpcMessage, data []byte) {
+	if len(data) < 2 {
+		fmt.Printf("[opc.handleFadecandySysex] message from %v is too short\n", opcMessage.Client)
+		return
+	}
+	sysexId := uint16(data[0])<<8 + uint16(data[1])
+	data = data[2:]
+	switch sysexId {
+	case FADECANDY_SET_COLOR_CORRECTION:
+		colorCorrection := FadecandyColorCorrection{Gamma: GAMMA, Whitepoint: [3]float64{1, 1, 1}}
+		if err := json.Unmarshal(data, &colorCorrection); err != nil {
+			fmt.Printf("[opc.handleFadecandySysex] bad color correction from %v: %v\n", opcMessage.Client, err)
+			return
+		}
+		fmt.Printf("[opc.handleFadecandySysex] %v set color correction to %+v\n", opcMessage.Client, colorCorrection)
+		server.fadecandyColorLookup = makeFadecandyColorLookup(colorCorrection)
+	case FADECANDY_SET_FIRMWARE_CONFIG:
+		if len(data) < 1 {
+			fmt.Printf("[opc.handleFadecandySysex] empty firmware config from %v\n", opcMessage.Client)
+			return
+		}
+		fmt.Printf("[opc.handleFadecandySysex] %v set firmware config to %#02x; ignoring it\n", opcMessage.Client, data[0])
+	default:
+		fmt.Printf("[opc.handleFadecandySysex] unknown sysex ID %#04x from %v\n", sysexId, opcMessage.Client)
+	}
+}
+
+// Build lookup tables which turn incoming pixel values into the values our output
+// threads expect.  Those already apply GAMMA on their way to the LEDs, so we only need
+// to apply whatever is left over after that.
+func makeFadecandyColorLookup(colorCorrection FadecandyColorCorrection) [][]byte {
+	lookup := make([][]byte, 3)
+	for cc := 0; cc < 3; cc++ {
+		lookup[cc] = make([]byte, 256)
+		whitepoint := math.Pow(math.Max(colorCorrection.Whitepoint[cc], 0), 1/GAMMA)
+		for ii := 0; ii < 256; ii++ {
+			floatVal := math.Pow(float64(ii)/255, colorCorrection.Gamma/GAMMA) * whitepoint
+			if floatVal >= 1 {
+				lookup[cc][ii] = 255
+			} else {
+				lookup[cc][ii] = byte(floatVal*255 + 0.5)
+			}
+		}
+	}
+	return lookup
+}
+
+// Apply the most recent color correction a FadeCandy client sent to this server to the pixels,
+// in place.  Do nothing if no client has set one.
+func (server *OpcServerState) applyFadecandyColorCorrection(bytes []byte) {
+	if server.fadecandyColorLookup == nil {
+		return
+	}
+	for ii := range bytes {
+		bytes[ii] = server.fadecandyColorLookup[ii%3][bytes[ii]]
+	}
+}
@@ -0,0 +1,121 @@
+package opc
+
+// Fan-out
+//   Send each frame to several destinations at once, like the local LED strip and a
+//   visualizer on another machine.
+//   Each destination gets its own copy of the frame and of the MidiState, and runs in its own
+//   goroutine.  We wait for all of them to finish, but only up to FANOUT_TIMEOUT; a destination
+//   which takes longer than that (say, an OPC destination waiting to reconnect) keeps working on
+//   its frame in the background and misses new frames until it's done, so it can't hold up the
+//   others.
+
+import (
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"time"
+)
+
+// How long to wait for the destinations to finish sending a frame
+const FANOUT_TIMEOUT = 100 // milliseconds
+
+// One destination of a fan-out.
+type fanOutDest struct {
+	index     int
+	thread    ByteThread
+	bytesIn   chan []byte // has room for one frame, so handing over a frame never blocks
+	bytesOut  chan []byte
+	buffer    []byte
+	midiState midi.MidiState // only changed while the destination isn't busy
+	busy      bool           // true while the destination is holding buffer
+	slow      bool           // true if the destination missed the deadline for its current frame
+}
+
+// Check whether the destination has finished sending its frame, without waiting.
+func (dest *fanOutDest) poll() {
+	select {
+	case <-dest.bytesOut:
+		dest.finished()
+	default:
+	}
+}
+
+func (dest *fanOutDest) finished() {
+	dest.busy = false
+	if dest.slow {
+		fmt.Printf("[opc.FanOutThread] destination %v caught up\n", dest.index)
+		dest.slow = false
+	}
+}
+
+// Return a ByteThread which hands each frame to all of the destThreads in parallel and waits up
+// to FANOUT_TIMEOUT for them to finish.  A destination which is still busy with an old frame
+// doesn't get the new one.
+func MakeFanOutThread(destThreads ...ByteThread) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		fmt.Println("[opc.FanOutThread] starting up")
+
+		dests := make([]*fanOutDest, len(destThreads))
+		for ii, thread := range destThreads {
+			dests[ii] = &fanOutDest{
+				index:    ii,
+				thread:   thread,
+				bytesIn:  make(chan []byte, 1),
+				bytesOut: make(chan []byte, 0),
+			}
+			go thread(dests[ii].bytesIn, dests[ii].bytesOut, &dests[ii].midiState)
+		}
+		defer func() {
+			for _, dest := range dests {
+				close(dest.bytesIn)
+			}
+		}()
+
+		for bytes := range bytesIn {
+			// hand a copy of the frame to each destination which is ready for it
+			started := make([]*fanOutDest, 0, len(dests))
+			for _, dest := range dests {
+				if dest.busy {
+					dest.poll()
+				}
+				if dest.busy {
+					continue
+				}
+				if len(dest.buffer) != len(bytes) {
+					dest.buffer = make([]byte, len(bytes))
+				}
+				copy(dest.buffer, bytes)
+				// the main loop changes midiState between frames, so the destination
+				// gets a copy which stays put while it works
+				if midiState != nil {
+					dest.midiState = *midiState
+				}
+				dest.busy = true
+				dest.bytesIn <- dest.buffer
+				started = append(started, dest)
+			}
+
+			// wait for them to finish, up to the deadline
+			deadline := time.After(FANOUT_TIMEOUT * time.Millisecond)
+			timedOut := false
+			for _, dest := range started {
+				if !timedOut {
+					select {
+					case <-dest.bytesOut:
+						dest.finished()
+						continue
+					case <-deadline:
+						timedOut = true
+					}
+				}
+				// past the deadline, the destinations only get a quick check
+				dest.poll()
+				if dest.busy {
+					fmt.Printf("[opc.FanOutThread] destination %v is too slow; skipping frames until it's done\n", dest.index)
+					dest.slow = true
+				}
+			}
+
+			bytesOut <- bytes
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package opc
+
+// Composite layouts
+//   Build one layout out of several fixtures, each read from its own layout file and moved
+//   into place, so patterns see the whole installation in a single coordinate space:
+//
+//	{
+//	  "fixtures": [
+//	    {"name": "left", "layout": "circle_r1_160x_vertical.json", "translate": [-2, 0, 0]},
+//	    {"name": "right", "layout": "circle_r1_160x_vertical.json", "translate": [2, 0, 0], "rotate": [0, 0, 180]},
+//	    {"name": "tower", "layout": "cylinder_r1_h2_32x20.json", "scale": [0.5, 0.5, 2]}
+//	  ]
+//	}
+//
+//   Fixtures are concatenated in the order they're listed, which should be their wiring order.
+//   Each fixture is scaled, then rotated (degrees around x, then y, then z), then translated.
+//   "scale" can be a single number or one number per axis.  Fixture layout files are found
+//   relative to the composite layout file, and can be composite layouts themselves.
+//   The groups, strips and formats of each fixture are kept, and a named fixture also becomes
+//   a group of its own.  The composite layout can add more groups and strips which refer to
+//   the pixels of the combined layout, and formats which override those of the fixtures.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+)
+
+// How deep composite layouts can be nested
+const MAX_LAYOUT_DEPTH = 8
+
+// One entry in the "fixtures" list of a composite layout.
+type LayoutFixture struct {
+	Name      string          `json:"name"`      // optional
+	Layout    string          `json:"layout"`    // path to a layout file
+	Translate [3]float64      `json:"translate"` // offset
+	Rotate    [3]float64      `json:"rotate"`    // degrees around x, y, and z
+	Scale     json.RawMessage `json:"scale"`     // a number or [x, y, z].  default 1
+}
+
+// Return the fixture's scale for each axis.
+func (fixture *LayoutFixture) scale() ([3]float64, error) {
+	if fixture.Scale == nil {
+		return [3]float64{1, 1, 1}, nil
+	}
+	var scale [3]float64
+	var uniform float64
+	if err := json.Unmarshal(fixture.Scale, &uniform); err == nil {
+		return [3]float64{uniform, uniform, uniform}, nil
+	}
+	var perAxis []float64
+	if err := json.Unmarshal(fixture.Scale, &perAxis); err != nil || len(perAxis) != 3 {
+		return scale, fmt.Errorf("scale should be a number or a list of 3 numbers, not %s", fixture.Scale)
+	}
+	copy(scale[:], perAxis)
+	return scale, nil
+}
+
+// Scale, rotate, and translate a point.
+func transformPoint(point, scale, rotate, translate [3]float64) [3]float64 {
+	x := point[0] * scale[0]
+	y := point[1] * scale[1]
+	z := point[2] * scale[2]
+
+	// around x
+	sin, cos := math.Sincos(rotate[0] * math.Pi / 180)
+	y, z = y*cos-z*sin, y*sin+z*cos
+	// around y
+	sin, cos = math.Sincos(rotate[1] * math.Pi / 180)
+	x, z = x*cos+z*sin, -x*sin+z*cos
+	// around z
+	sin, cos = math.Sincos(rotate[2] * math.Pi / 180)
+	x, y = x*cos-y*sin, x*sin+y*cos
+
+	return [3]float64{x + translate[0], y + translate[1], z + translate[2]}
+}
+
+// Read each fixture's layout file from dir, move it into place, and concatenate them
+// into one layout.
+// Also return the names of any groups which have different formats in different fixtures;
+// the composite layout has to give those groups a format of its own.
+func composeFixtures(fixtures []LayoutFixture, dir string, depth int) (*Layout, map[string]bool, error) {
+	if depth >= MAX_LAYOUT_DEPTH {
+		return nil, nil, fmt.Errorf("composite layouts are nested more than %v deep", MAX_LAYOUT_DEPTH)
+	}
+	formatConflicts := make(map[string]bool)
+	layout := &Layout{Groups: make(map[string][]PixelRange), Formats: make(map[string]PixelFormat)}
+	for ii, fixture := range fixtures {
+		if fixture.Layout == "" {
+			return nil, nil, fmt.Errorf("fixture %v has no layout", ii)
+		}
+		scale, err := fixture.scale()
+		if err != nil {
+			return nil, nil, fmt.Errorf("fixture %v: %v", ii, err)
+		}
+		fn := fixture.Layout
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(dir, fn)
+		}
+		fixtureLayout, err := readLayout(fn, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// offset all the fixture's pixel indices by the number of pixels before it
+		offset := len(layout.Pixels)
+		for _, pixel := range fixtureLayout.Pixels {
+			pixel.Point = transformPoint(pixel.Point, scale, fixture.Rotate, fixture.Translate)
+			layout.Pixels = append(layout.Pixels, pixel)
+		}
+		for name, pixelRanges := range fixtureLayout.Groups {
+			for _, pixelRange := range pixelRanges {
+				layout.Groups[name] = append(layout.Groups[name], PixelRange{pixelRange.First + offset, pixelRange.Count})
+			}
+		}
+		for _, strip := range fixtureLayout.Strips {
+			strip.First += offset
+			layout.Strips = append(layout.Strips, strip)
+		}
+		for name, pixelFormat := range fixtureLayout.Formats {
+			if other, ok := layout.Formats[name]; ok && other != pixelFormat {
+				formatConflicts[name] = true
+			}
+			layout.Formats[name] = pixelFormat
+		}
+		if fixture.Name != "" && len(fixtureLayout.Pixels) > 0 {
+			layout.Groups[fixture.Name] = append(layout.Groups[fixture.Name], PixelRange{offset, len(fixtureLayout.Pixels)})
+		}
+	}
+	return layout, formatConflicts, nil
+}
@@ -0,0 +1,159 @@
+package opc
+
+// Layout shapes
+//   Generate layouts for some common fixtures, and write layouts out as JSON files
+//   in the same format ReadLayout reads.
+//   Shapes are centered on the origin.  Round things go clockwise around the z axis
+//   starting at +y, in the x-y plane (or the x-z plane for vertical circles).
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Which order the pixels of a grid are wired in
+const (
+	WIRING_ROWS           = "rows"           // left to right along each row, top row first
+	WIRING_COLUMNS        = "columns"        // top to bottom along each column, left column first
+	WIRING_ZIGZAG_ROWS    = "zigzag-rows"    // like rows, but every other row goes right to left
+	WIRING_ZIGZAG_COLUMNS = "zigzag-columns" // like columns, but every other column goes bottom to top
+)
+
+func makeLayoutFromPoints(points [][3]float64) *Layout {
+	layout := &Layout{Groups: make(map[string][]PixelRange), Formats: make(map[string]PixelFormat)}
+	for _, point := range points {
+		layout.Pixels = append(layout.Pixels, LayoutPixel{Point: point})
+	}
+	return layout
+}
+
+// A ring of count pixels.
+// If vertical, the ring stands up in the x-z plane instead of lying in the x-y plane.
+func MakeCircleLayout(radius float64, count int, vertical bool) *Layout {
+	points := make([][3]float64, count)
+	for ii := range points {
+		angle := float64(ii) / float64(count) * 2 * math.Pi
+		x := radius * math.Sin(angle)
+		y := radius * math.Cos(angle)
+		if vertical {
+			points[ii] = [3]float64{x, 0, y}
+		} else {
+			points[ii] = [3]float64{x, y, 0}
+		}
+	}
+	return makeLayoutFromPoints(points)
+}
+
+// A stack of rings, each with around pixels, from the bottom (z = -height/2) to the top.
+// If zigzag, every other ring is wired counterclockwise.
+func MakeCylinderLayout(radius, height float64, around, rings int, zigzag bool) *Layout {
+	points := make([][3]float64, 0, around*rings)
+	for rr := 0; rr < rings; rr++ {
+		z := -height / 2
+		if rings > 1 {
+			z += height * float64(rr) / float64(rings-1)
+		}
+		for aa := 0; aa < around; aa++ {
+			step := aa
+			if zigzag && rr%2 == 1 {
+				step = (around - aa) % around
+			}
+			angle := float64(step) / float64(around) * 2 * math.Pi
+			points = append(points, [3]float64{radius * math.Sin(angle), radius * math.Cos(angle), z})
+		}
+	}
+	return makeLayoutFromPoints(points)
+}
+
+// A spiral of count pixels winding clockwise around the z axis turns times,
+// from the bottom (z = -height/2) to the top.
+func MakeHelixLayout(radius, height float64, count int, turns float64) *Layout {
+	points := make([][3]float64, count)
+	for ii := range points {
+		pct := 0.0
+		if count > 1 {
+			pct = float64(ii) / float64(count-1)
+		}
+		angle := pct * turns * 2 * math.Pi
+		points[ii] = [3]float64{radius * math.Sin(angle), radius * math.Cos(angle), height * (pct - 0.5)}
+	}
+	return makeLayoutFromPoints(points)
+}
+
+// A flat, upright grid of columns x rows pixels in the x-z plane, wired according to
+// wiring (one of the WIRING_* constants).
+func MakeGridLayout(width, height float64, columns, rows int, wiring string) *Layout {
+	// position of a pixel along an axis, from -size/2 to size/2
+	position := func(ii, n int, size float64) float64 {
+		if n < 2 {
+			return 0
+		}
+		return size * (float64(ii)/float64(n-1) - 0.5)
+	}
+	points := make([][3]float64, 0, columns*rows)
+	addPoint := func(cc, rr int) {
+		points = append(points, [3]float64{position(cc, columns, width), 0, -position(rr, rows, height)})
+	}
+	switch wiring {
+	case WIRING_COLUMNS, WIRING_ZIGZAG_COLUMNS:
+		for cc := 0; cc < columns; cc++ {
+			for ii := 0; ii < rows; ii++ {
+				rr := ii
+				if wiring == WIRING_ZIGZAG_COLUMNS && cc%2 == 1 {
+					rr = rows - 1 - ii
+				}
+				addPoint(cc, rr)
+			}
+		}
+	default:
+		for rr := 0; rr < rows; rr++ {
+			for ii := 0; ii < columns; ii++ {
+				cc := ii
+				if wiring == WIRING_ZIGZAG_ROWS && rr%2 == 1 {
+					cc = columns - 1 - ii
+				}
+				addPoint(cc, rr)
+			}
+		}
+	}
+	return makeLayoutFromPoints(points)
+}
+
+// Reverse the wiring order of the layout's pixels, renumbering its groups and strips to match.
+func (layout *Layout) Reverse() {
+	*layout = *layout.Subset(PixelRange{0, len(layout.Pixels)}, true)
+}
+
+// Repeat the layout's pixels so there are times copies of them, one after another, like strips
+// which are stacked on top of each other.  Groups and strips stay on the first copy.
+func (layout *Layout) Repeat(times int) {
+	pixels := layout.Pixels
+	for ii := 1; ii < times; ii++ {
+		layout.Pixels = append(layout.Pixels, pixels...)
+	}
+}
+
+// Format a coordinate the way our layout files do.  Tiny negative numbers come out as "-0.0000",
+// like they do in the files in layouts/.
+func formatCoord(v float64) string {
+	return fmt.Sprintf("%.4f", v)
+}
+
+// Write the layout's pixels as an OPC-style JSON layout file, one pixel per line.
+// Only the points are written, so the result is readable by other OPC tools.
+func (layout *Layout) WriteJson(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintln(writer, "[")
+	for ii, pixel := range layout.Pixels {
+		comma := ","
+		if ii == len(layout.Pixels)-1 {
+			comma = ""
+		}
+		fmt.Fprintf(writer, "  {\"point\": [%s, %s, %s]}%s\n",
+			formatCoord(pixel.Point[0]), formatCoord(pixel.Point[1]), formatCoord(pixel.Point[2]), comma)
+	}
+	fmt.Fprintln(writer, "]")
+	return writer.Flush()
+}
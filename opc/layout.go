@@ -0,0 +1,340 @@
+package opc
+
+// Layout
+//   Reads OPC-style JSON layout files, which hold a list of pixels in wiring order:
+//
+//	[
+//	  {"point": [0.0000, 1.0000, 0.1000]},
+//	  {"point": [0.0393, 0.9992, 0.0000]}
+//	]
+//
+//   Each pixel must have a "point" with exactly 3 coordinates.  Any other fields are kept.
+//
+//   A layout file can also be an object which wraps that list and adds named groups of pixels
+//   (so effects can refer to regions like "arch" by name) and physical strips with attributes
+//   (so output drivers can treat different kinds of strip differently):
+//
+//	{
+//	  "pixels": [
+//	    {"point": [0.0000, 1.0000, 0.1000]},
+//	    ...
+//	  ],
+//	  "groups": {
+//	    "circle": [{"first": 0, "count": 160}],
+//	    "arch": [{"first": 160, "count": 320}]
+//	  },
+//	  "strips": [
+//	    {"name": "circle", "first": 0, "count": 160, "backing": "copper"},
+//	    {"name": "arch", "first": 160, "count": 320, "backing": "white"}
+//	  ]
+//	}
+//
+//   A group can be made of several ranges.  Strips can't overlap.  Any fields of a strip
+//   other than name, first and count are its attributes.
+//
+//   Instead of "pixels", the object can have "fixtures", which build the layout out of other
+//   layout files.  See layout-composite.go.
+//
+//   Groups can also have "formats" which tell output drivers about their color order and
+//   white balance.  See pixel-format.go.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+)
+
+// A layout file, pixels and all.
+type Layout struct {
+	Pixels  []LayoutPixel
+	Groups  map[string][]PixelRange // named regions of the layout
+	Strips  []LayoutStrip           // physical strips, in wiring order
+	Formats map[string]PixelFormat  // how output drivers should adjust the colors of each group
+}
+
+// One physical strip of pixels within a layout.
+type LayoutStrip struct {
+	Name string
+	PixelRange
+	Attributes map[string]json.RawMessage // any other fields from the JSON, by name
+}
+
+// One pixel from a layout file.
+type LayoutPixel struct {
+	Point [3]float64
+	Extra map[string]json.RawMessage // any other fields from the JSON, by name
+}
+
+// Parse the contents of a layout file.
+// Return an error if it isn't a JSON list of objects which each have a 3-element "point".
+func ParseLayoutPixels(data []byte) ([]LayoutPixel, error) {
+	var entries []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	pixels := make([]LayoutPixel, len(entries))
+	for ii, entry := range entries {
+		rawPoint, ok := entry["point"]
+		if !ok {
+			return nil, fmt.Errorf("pixel %v has no point", ii)
+		}
+		var point []float64
+		if err := json.Unmarshal(rawPoint, &point); err != nil {
+			return nil, fmt.Errorf("pixel %v has a bad point %s: %v", ii, rawPoint, err)
+		}
+		if len(point) != 3 {
+			return nil, fmt.Errorf("pixel %v has a point with %v coordinates instead of 3", ii, len(point))
+		}
+		copy(pixels[ii].Point[:], point)
+		delete(entry, "point")
+		if len(entry) > 0 {
+			pixels[ii].Extra = entry
+		}
+	}
+	return pixels, nil
+}
+
+// Read locations from OPC-style JSON layout file into a slice of floats
+// in [x y z  x y z  x y z ... ] order.
+func ReadLocations(fn string) ([]float64, error) {
+	layout, err := ReadLayout(fn)
+	if err != nil {
+		return nil, err
+	}
+	return layout.Locations(), nil
+}
+
+// Parse the contents of a layout file, which can be either a plain list of pixels or an
+// object with pixels (or fixtures), groups and strips.
+// Fixture layout files are found relative to the current directory.
+// Return an error if the pixels can't be parsed or any group or strip doesn't fit the pixels.
+func ParseLayout(data []byte) (*Layout, error) {
+	return parseLayout(data, ".", 0)
+}
+
+// Like ParseLayout, but find fixture layout files relative to dir.
+// depth is how many composite layouts deep we are, to catch layouts which include themselves.
+func parseLayout(data []byte, dir string, depth int) (*Layout, error) {
+	layout := &Layout{Groups: make(map[string][]PixelRange), Formats: make(map[string]PixelFormat)}
+	var err error
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		// plain list of pixels
+		if layout.Pixels, err = ParseLayoutPixels(data); err != nil {
+			return nil, err
+		}
+		return layout, nil
+	}
+
+	var layoutJson struct {
+		Pixels   json.RawMessage
+		Fixtures []LayoutFixture
+		Groups   map[string][]PixelRange
+		Strips   []map[string]json.RawMessage
+		Formats  map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(data, &layoutJson); err != nil {
+		return nil, err
+	}
+	var formatConflicts map[string]bool
+	if layoutJson.Fixtures != nil {
+		if layoutJson.Pixels != nil {
+			return nil, fmt.Errorf("a layout can't have both pixels and fixtures")
+		}
+		if layout, formatConflicts, err = composeFixtures(layoutJson.Fixtures, dir, depth); err != nil {
+			return nil, err
+		}
+	} else if layout.Pixels, err = ParseLayoutPixels(layoutJson.Pixels); err != nil {
+		return nil, err
+	}
+	nPixels := len(layout.Pixels)
+
+	for name, pixelRanges := range layoutJson.Groups {
+		for _, pixelRange := range pixelRanges {
+			if pixelRange.First < 0 || pixelRange.Count < 1 || pixelRange.First+pixelRange.Count > nPixels {
+				return nil, fmt.Errorf("group %q covers pixels %v to %v but there are only %v pixels",
+					name, pixelRange.First, pixelRange.First+pixelRange.Count-1, nPixels)
+			}
+		}
+		layout.Groups[name] = append(layout.Groups[name], pixelRanges...)
+	}
+
+	for ii, stripJson := range layoutJson.Strips {
+		strip := LayoutStrip{}
+		for key, target := range map[string]interface{}{"name": &strip.Name, "first": &strip.First, "count": &strip.Count} {
+			raw, ok := stripJson[key]
+			if !ok {
+				return nil, fmt.Errorf("strip %v has no %s", ii, key)
+			}
+			if err := json.Unmarshal(raw, target); err != nil {
+				return nil, fmt.Errorf("strip %v has a bad %s: %v", ii, key, err)
+			}
+			delete(stripJson, key)
+		}
+		if strip.First < 0 || strip.Count < 1 || strip.First+strip.Count > nPixels {
+			return nil, fmt.Errorf("strip %q covers pixels %v to %v but there are only %v pixels",
+				strip.Name, strip.First, strip.First+strip.Count-1, nPixels)
+		}
+		if len(stripJson) > 0 {
+			strip.Attributes = stripJson
+		}
+		layout.Strips = append(layout.Strips, strip)
+	}
+	sort.Slice(layout.Strips, func(a, b int) bool { return layout.Strips[a].First < layout.Strips[b].First })
+	for ii := 1; ii < len(layout.Strips); ii++ {
+		prev := layout.Strips[ii-1]
+		if prev.First+prev.Count > layout.Strips[ii].First {
+			return nil, fmt.Errorf("strips %q and %q overlap", prev.Name, layout.Strips[ii].Name)
+		}
+	}
+
+	// formats here override any from the fixtures
+	for name, raw := range layoutJson.Formats {
+		if layout.Formats[name], err = parsePixelFormat(raw); err != nil {
+			return nil, fmt.Errorf("format %q: %v", name, err)
+		}
+		delete(formatConflicts, name)
+	}
+	for name := range formatConflicts {
+		return nil, fmt.Errorf("fixtures have different formats for group %q", name)
+	}
+	if err := layout.checkFormats(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// Read a layout file.
+func ReadLayout(fn string) (*Layout, error) {
+	layout, err := readLayout(fn, 0)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[opc.ReadLayout] Read %v pixels, %v groups and %v strips from %s\n", len(layout.Pixels), len(layout.Groups), len(layout.Strips), fn)
+	return layout, nil
+}
+
+func readLayout(fn string, depth int) (*Layout, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := parseLayout(data, filepath.Dir(fn), depth)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return layout, nil
+}
+
+// Return the pixel locations as a slice of floats in [x y z  x y z  x y z ... ] order,
+// which is what patterns and effects expect.
+func (layout *Layout) Locations() []float64 {
+	locations := make([]float64, 0, len(layout.Pixels)*3)
+	for _, pixel := range layout.Pixels {
+		locations = append(locations, pixel.Point[:]...)
+	}
+	return locations
+}
+
+// Return a hash of the pixel locations, which changes if pixels are added, removed, or moved.
+// Recordings use it to check that they're played back on the layout they were made with.
+func (layout *Layout) Hash() [sha256.Size]byte {
+	hash := sha256.New()
+	for _, v := range layout.Locations() {
+		binary.Write(hash, binary.BigEndian, math.Float64bits(v))
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// Return a slice with one bool per pixel which is true for the pixels in the named group.
+// If there's no such group, all the values are false.
+func (layout *Layout) GroupMask(name string) []bool {
+	mask := make([]bool, len(layout.Pixels))
+	for _, pixelRange := range layout.Groups[name] {
+		for ii := pixelRange.First; ii < pixelRange.First+pixelRange.Count; ii++ {
+			mask[ii] = true
+		}
+	}
+	return mask
+}
+
+// Return the strip which the given pixel belongs to, or nil if it's not part of any strip.
+func (layout *Layout) StripForPixel(ii int) *LayoutStrip {
+	for ss := range layout.Strips {
+		strip := &layout.Strips[ss]
+		if strip.First <= ii && ii < strip.First+strip.Count {
+			return strip
+		}
+	}
+	return nil
+}
+
+// Return the strip's attribute as a string, or "" if it doesn't have one or it isn't a string.
+func (strip *LayoutStrip) StringAttribute(name string) string {
+	var value string
+	if raw, ok := strip.Attributes[name]; ok {
+		json.Unmarshal(raw, &value)
+	}
+	return value
+}
+
+// Return a new layout holding just the pixels in pixelRange, in reverse order if reverse is
+// true, so that an output which only drives part of the layout can treat it as a whole layout.
+// Groups and strips are clipped to the range and renumbered, and groups keep their formats.
+func (layout *Layout) Subset(pixelRange PixelRange, reverse bool) *Layout {
+	first, last := pixelRange.First, pixelRange.First+pixelRange.Count // last is exclusive
+
+	// clip a range to the subset and renumber it
+	subsetRange := func(r PixelRange) (PixelRange, bool) {
+		a, b := r.First, r.First+r.Count
+		if a < first {
+			a = first
+		}
+		if b > last {
+			b = last
+		}
+		if a >= b {
+			return PixelRange{}, false
+		}
+		if reverse {
+			return PixelRange{last - b, b - a}, true
+		}
+		return PixelRange{a - first, b - a}, true
+	}
+
+	subset := &Layout{Groups: make(map[string][]PixelRange), Formats: make(map[string]PixelFormat)}
+	for ii := 0; ii < pixelRange.Count; ii++ {
+		jj := first + ii
+		if reverse {
+			jj = last - 1 - ii
+		}
+		subset.Pixels = append(subset.Pixels, layout.Pixels[jj])
+	}
+	for name, pixelRanges := range layout.Groups {
+		for _, r := range pixelRanges {
+			if r, ok := subsetRange(r); ok {
+				subset.Groups[name] = append(subset.Groups[name], r)
+			}
+		}
+	}
+	for name, pixelFormat := range layout.Formats {
+		if _, ok := subset.Groups[name]; ok {
+			subset.Formats[name] = pixelFormat
+		}
+	}
+	for _, strip := range layout.Strips {
+		if r, ok := subsetRange(strip.PixelRange); ok {
+			strip.PixelRange = r
+			subset.Strips = append(subset.Strips, strip)
+		}
+	}
+	sort.Slice(subset.Strips, func(a, b int) bool { return subset.Strips[a].First < subset.Strips[b].First })
+	return subset
+}
@@ -0,0 +1,644 @@
+package opc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//================================================================================
+// LAYOUT FILES
+
+func TestReadAllLayouts(t *testing.T) {
+	fns, err := filepath.Glob("../layouts/*.json")
+	if err != nil || len(fns) == 0 {
+		t.Fatalf("couldn't find any layout files: %v", err)
+	}
+	for _, fn := range fns {
+		if strings.HasSuffix(fn, ".channels.json") {
+			continue
+		}
+		locations, err := ReadLocations(fn)
+		if err != nil {
+			t.Errorf("ReadLocations(%s) failed: %v", fn, err)
+			continue
+		}
+		if len(locations) == 0 || len(locations)%3 != 0 {
+			t.Errorf("ReadLocations(%s) returned %v floats", fn, len(locations))
+		}
+	}
+}
+
+//================================================================================
+// PARSING
+
+func TestParseLayoutPixels(t *testing.T) {
+	// formatting shouldn't matter
+	layouts := []string{
+		`[{"point": [1, 2, 3]}, {"point": [4, 5, 6]}]`,
+		"[{\"point\":[1,2,3]},\n\n{\"point\":\n[4.0, 5.0, 6.0]}\n]",
+		"[\n\t{ \"point\" : [ 1 , 2 , 3 ] } ,\n\t{ \"point\" : [ 4e0 , 5 , 6 ] }\n]\n",
+	}
+	for _, layout := range layouts {
+		pixels, err := ParseLayoutPixels([]byte(layout))
+		if err != nil {
+			t.Errorf("ParseLayoutPixels(%q) failed: %v", layout, err)
+			continue
+		}
+		if len(pixels) != 2 || pixels[0].Point != [3]float64{1, 2, 3} || pixels[1].Point != [3]float64{4, 5, 6} {
+			t.Errorf("ParseLayoutPixels(%q) = %v", layout, pixels)
+		}
+	}
+}
+
+func TestParseLayoutPixelsExtraFields(t *testing.T) {
+	pixels, err := ParseLayoutPixels([]byte(`[{"point": [1, 2, 3], "strip": "copper", "index": 7}, {"point": [4, 5, 6]}]`))
+	if err != nil {
+		t.Fatalf("ParseLayoutPixels failed: %v", err)
+	}
+	if string(pixels[0].Extra["strip"]) != `"copper"` || string(pixels[0].Extra["index"]) != "7" || len(pixels[0].Extra) != 2 {
+		t.Errorf("extra fields = %v", pixels[0].Extra)
+	}
+	if pixels[1].Extra != nil {
+		t.Errorf("pixel without extra fields has %v", pixels[1].Extra)
+	}
+}
+
+func TestParseLayoutPixelsErrors(t *testing.T) {
+	layouts := []string{
+		``,
+		`{"point": [1, 2, 3]}`,
+		`[{"point": [1, 2, 3]} {"point": [4, 5, 6]}]`,
+		`[{"point": [1, 2, 3]},]`,
+		`[{"point": [1, 2]}]`,
+		`[{"point": [1, 2, 3, 4]}]`,
+		`[{"point": [1, "2", 3]}]`,
+		`[{"location": [1, 2, 3]}]`,
+		`[[1, 2, 3]]`,
+	}
+	for _, layout := range layouts {
+		if pixels, err := ParseLayoutPixels([]byte(layout)); err == nil {
+			t.Errorf("ParseLayoutPixels(%q) = %v, want an error", layout, pixels)
+		}
+	}
+}
+
+//================================================================================
+// GROUPS AND STRIPS
+
+const testLayoutWithMetadata = `{
+  "pixels": [
+    {"point": [0, 0, 0]}, {"point": [1, 0, 0]}, {"point": [2, 0, 0]},
+    {"point": [3, 0, 0]}, {"point": [4, 0, 0]}, {"point": [5, 0, 0]}
+  ],
+  "groups": {
+    "ends": [{"first": 0, "count": 1}, {"first": 5, "count": 1}],
+    "middle": [{"first": 2, "count": 2}]
+  },
+  "strips": [
+    {"name": "b", "first": 3, "count": 3, "backing": "white"},
+    {"name": "a", "first": 0, "count": 2, "backing": "copper", "chips": 2}
+  ]
+}`
+
+func TestParseLayoutMetadata(t *testing.T) {
+	layout, err := ParseLayout([]byte(testLayoutWithMetadata))
+	if err != nil {
+		t.Fatalf("ParseLayout failed: %v", err)
+	}
+	if len(layout.Pixels) != 6 || layout.Locations()[3] != 1 {
+		t.Errorf("pixels = %v", layout.Pixels)
+	}
+
+	// groups
+	ends := layout.GroupMask("ends")
+	want := []bool{true, false, false, false, false, true}
+	for ii := range want {
+		if ends[ii] != want[ii] {
+			t.Errorf("GroupMask(ends) = %v, want %v", ends, want)
+			break
+		}
+	}
+	for _, v := range layout.GroupMask("nonexistent") {
+		if v {
+			t.Errorf("missing group should have an empty mask")
+		}
+	}
+
+	// strips are sorted by wiring order and keep their attributes
+	if len(layout.Strips) != 2 || layout.Strips[0].Name != "a" || layout.Strips[1].Name != "b" {
+		t.Fatalf("strips = %v", layout.Strips)
+	}
+	if string(layout.Strips[0].Attributes["chips"]) != "2" || len(layout.Strips[0].Attributes) != 2 {
+		t.Errorf("strip attributes = %v", layout.Strips[0].Attributes)
+	}
+	stripNames := []string{"a", "a", "", "b", "b", "b"}
+	for ii, name := range stripNames {
+		strip := layout.StripForPixel(ii)
+		if (strip == nil && name != "") || (strip != nil && strip.Name != name) {
+			t.Errorf("StripForPixel(%v) = %v, want %q", ii, strip, name)
+		}
+	}
+	if backing := layout.StripForPixel(4).StringAttribute("backing"); backing != "white" {
+		t.Errorf("backing = %q, want white", backing)
+	}
+	if missing := layout.StripForPixel(0).StringAttribute("chips"); missing != "" {
+		t.Errorf("non-string attribute = %q, want empty", missing)
+	}
+}
+
+func TestParseLayoutMetadataErrors(t *testing.T) {
+	pixels := `"pixels": [{"point": [0, 0, 0]}, {"point": [1, 0, 0]}]`
+	layouts := []string{
+		`{"pixels": [{"point": [0, 0]}]}`,
+		`{` + pixels + `, "groups": {"a": [{"first": 1, "count": 2}]}}`,
+		`{` + pixels + `, "groups": {"a": [{"first": -1, "count": 1}]}}`,
+		`{` + pixels + `, "strips": [{"name": "a", "first": 0, "count": 3}]}`,
+		`{` + pixels + `, "strips": [{"name": "a", "first": 0}]}`,
+		`{` + pixels + `, "strips": [{"name": 7, "first": 0, "count": 1}]}`,
+		`{` + pixels + `, "strips": [{"name": "a", "first": 0, "count": 2}, {"name": "b", "first": 1, "count": 1}]}`,
+	}
+	for _, layout := range layouts {
+		if _, err := ParseLayout([]byte(layout)); err == nil {
+			t.Errorf("ParseLayout(%q) should have failed", layout)
+		}
+	}
+}
+
+func TestMetalTowerLayout(t *testing.T) {
+	layout, err := ReadLayout("../layouts/metal_tower_final.json")
+	if err != nil {
+		t.Fatalf("ReadLayout failed: %v", err)
+	}
+	for _, name := range []string{"circle", "arch", "back"} {
+		if _, ok := layout.Groups[name]; !ok {
+			t.Errorf("metal tower layout has no %q group", name)
+		}
+	}
+	if layout.StripForPixel(0).StringAttribute("backing") != "copper" || layout.StripForPixel(799).StringAttribute("backing") != "white" {
+		t.Errorf("metal tower strips = %v", layout.Strips)
+	}
+	// the strips with white backing need their own color order and white balance
+	pixelFormats := layout.PixelFormats()
+	whiteBacking := PixelFormat{ColorOrder: "BRG", WhiteBalance: [3]float64{1, 0.8, 0.7}}
+	if pixelFormats[0] != DEFAULT_PIXEL_FORMAT || pixelFormats[160] != whiteBacking || pixelFormats[799] != whiteBacking {
+		t.Errorf("metal tower pixel formats = %v, %v, %v", pixelFormats[0], pixelFormats[160], pixelFormats[799])
+	}
+}
+
+//================================================================================
+// PIXEL FORMATS
+
+func TestLayoutFormats(t *testing.T) {
+	layout, err := ParseLayout([]byte(`{
+		"pixels": [{"point": [0, 0, 0]}, {"point": [1, 0, 0]}, {"point": [2, 0, 0]}, {"point": [3, 0, 0]}],
+		"groups": {"a": [{"first": 0, "count": 1}], "b": [{"first": 2, "count": 2}], "all": [{"first": 0, "count": 4}]},
+		"formats": {
+			"a": {"color_order": "bgr"},
+			"b": {"white_balance": [1, 0.5, 0.25]}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("ParseLayout failed: %v", err)
+	}
+	want := []PixelFormat{
+		{ColorOrder: "BGR", WhiteBalance: [3]float64{1, 1, 1}},
+		DEFAULT_PIXEL_FORMAT,
+		{WhiteBalance: [3]float64{1, 0.5, 0.25}},
+		{WhiteBalance: [3]float64{1, 0.5, 0.25}},
+	}
+	pixelFormats := layout.PixelFormats()
+	for ii := range want {
+		if pixelFormats[ii] != want[ii] {
+			t.Errorf("pixel %v format = %+v, want %+v", ii, pixelFormats[ii], want[ii])
+		}
+	}
+
+	// outputs which only drive part of the layout keep the formats of their groups
+	subset := layout.Subset(PixelRange{1, 2}, false)
+	if pixelFormats := subset.PixelFormats(); pixelFormats[0] != DEFAULT_PIXEL_FORMAT || pixelFormats[1] != want[2] {
+		t.Errorf("subset pixel formats = %v", pixelFormats)
+	}
+
+	bad := []string{
+		`"nope": {"color_order": "RGB"}`,
+		`"a": {"color_order": "RGBW"}`,
+		`"a": {"white_balance": [1, 1]}`,
+		`"a": {"white_balance": [1, -1, 1]}`,
+		`"a": {"white_balance": [1, 1, 1], "color_temperature": 3000}`,
+		`"a": {"color_temperature": 10}`,
+		`"a": {}, "all": {}`,
+	}
+	for _, formats := range bad {
+		data := `{"pixels": [{"point": [0, 0, 0]}, {"point": [1, 0, 0]}],
+			"groups": {"a": [{"first": 0, "count": 1}], "all": [{"first": 0, "count": 2}]},
+			"formats": {` + formats + `}}`
+		if _, err := ParseLayout([]byte(data)); err == nil {
+			t.Errorf("ParseLayout with formats {%s} should have failed", formats)
+		}
+	}
+}
+
+func TestColorTemperatureWhiteBalance(t *testing.T) {
+	neutral := colorTemperatureWhiteBalance(NEUTRAL_COLOR_TEMPERATURE)
+	for cc := range neutral {
+		if math.Abs(neutral[cc]-1) > 1e-9 {
+			t.Errorf("neutral white balance = %v", neutral)
+		}
+	}
+	// warm light has less blue than green and less green than red
+	warm := colorTemperatureWhiteBalance(3000)
+	if !(warm[0] == 1 && warm[1] < 1 && warm[2] < warm[1]) {
+		t.Errorf("3000K white balance = %v", warm)
+	}
+	// cool light has less red
+	cool := colorTemperatureWhiteBalance(10000)
+	if !(cool[2] == 1 && cool[0] < 1) {
+		t.Errorf("10000K white balance = %v", cool)
+	}
+}
+
+func TestCompositeLayoutFormats(t *testing.T) {
+	dir := writeTestLayouts(t, map[string]string{
+		"strip.json": `{
+			"pixels": [{"point": [0, 0, 0]}, {"point": [1, 0, 0]}],
+			"groups": {"strip": [{"first": 0, "count": 2}]},
+			"formats": {"strip": {"color_order": "BRG"}}
+		}`,
+		"other.json": `{
+			"pixels": [{"point": [0, 0, 0]}],
+			"groups": {"strip": [{"first": 0, "count": 1}]},
+			"formats": {"strip": {"color_order": "GRB"}}
+		}`,
+		"twice.json":    `{"fixtures": [{"layout": "strip.json"}, {"layout": "strip.json"}]}`,
+		"override.json": `{"fixtures": [{"layout": "strip.json"}, {"layout": "other.json"}], "formats": {"strip": {}}}`,
+		"conflict.json": `{"fixtures": [{"layout": "strip.json"}, {"layout": "other.json"}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	layout, err := ReadLayout(filepath.Join(dir, "twice.json"))
+	if err != nil {
+		t.Fatalf("ReadLayout failed: %v", err)
+	}
+	for ii, pixelFormat := range layout.PixelFormats() {
+		if pixelFormat.ColorOrder != "BRG" {
+			t.Errorf("pixel %v of the composite has format %v", ii, pixelFormat)
+		}
+	}
+	if layout, err = ReadLayout(filepath.Join(dir, "override.json")); err != nil {
+		t.Errorf("ReadLayout(override.json) failed: %v", err)
+	} else if layout.PixelFormats()[0] != DEFAULT_PIXEL_FORMAT {
+		t.Errorf("the composite's format didn't override the fixtures'")
+	}
+	if _, err := ReadLayout(filepath.Join(dir, "conflict.json")); err == nil {
+		t.Errorf("ReadLayout(conflict.json) should have failed")
+	}
+}
+
+//================================================================================
+// SHAPES
+
+func TestShapeLayoutsMatchFiles(t *testing.T) {
+	// what layoutgen makes for each of the circles and cylinders in layouts/
+	repeated := func(layout *Layout, times int) *Layout {
+		layout.Repeat(times)
+		return layout
+	}
+	// the 160 pixel circles were written with a space after the "["
+	spaceAfterBracket := func(generated string) string {
+		return strings.Replace(generated, "[\n", "[ \n", 1)
+	}
+	cases := map[string]struct {
+		layout *Layout
+		fixup  func(generated string) string // the differences which were made to the file by hand
+	}{
+		"circle_r1_50x":            {MakeCircleLayout(1, 50, false), nil},
+		"circle_r1_160x_vertical":  {MakeCircleLayout(1, 160, true), spaceAfterBracket},
+		"circle_r1_160x2_vertical": {repeated(MakeCircleLayout(1, 160, true), 2), spaceAfterBracket},
+		"circle_r1_160x5_vertical": {repeated(MakeCircleLayout(1, 160, true), 5), spaceAfterBracket},
+		// the first pixel of this one was raised by 0.1
+		"circle_r1_160x": {MakeCircleLayout(1, 160, false), func(generated string) string {
+			generated = strings.Replace(generated, "[0.0000, 1.0000, 0.0000]", "[0.0000, 1.0000, 0.1000]", 1)
+			return spaceAfterBracket(generated)
+		}},
+		// the names don't follow the parameters: "h" is half the height of some and all of
+		// the height of others, and the 32x20 cylinder has 10 rings
+		"cylinder_r1_h1_64x20":    {MakeCylinderLayout(1, 2, 64, 20, false), nil},
+		"cylinder_r1_h2_32x20":    {MakeCylinderLayout(1, 2, 32, 10, false), nil},
+		"cylinder_r2_h0.5_128x10": {MakeCylinderLayout(2, 1, 128, 10, false), nil},
+	}
+
+	fns, err := filepath.Glob("../layouts/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range fns {
+		name := strings.TrimSuffix(filepath.Base(fn), ".json")
+		isExtra := strings.HasSuffix(name, ".channels") || strings.HasSuffix(name, ".universes")
+		if (strings.HasPrefix(name, "circle_") || strings.HasPrefix(name, "cylinder_")) && !isExtra {
+			if _, ok := cases[name]; !ok {
+				t.Errorf("%s looks like a shape layout but isn't checked here", fn)
+			}
+		}
+	}
+
+	for name, c := range cases {
+		want, err := ioutil.ReadFile(filepath.Join("..", "layouts", name+".json"))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := c.layout.WriteJson(&buf); err != nil {
+			t.Fatal(err)
+		}
+		generated := buf.String()
+		if c.fixup != nil {
+			generated = c.fixup(generated)
+		}
+		if generated != string(want) {
+			t.Errorf("generated layout doesn't match %s.json", name)
+		}
+	}
+}
+
+func TestShapeLayoutsRoundTrip(t *testing.T) {
+	layouts := map[string]*Layout{
+		"circle":   MakeCircleLayout(2, 10, true),
+		"cylinder": MakeCylinderLayout(1, 2, 8, 4, true),
+		"helix":    MakeHelixLayout(1, 3, 30, 2.5),
+		"grid":     MakeGridLayout(4, 2, 5, 3, WIRING_ZIGZAG_ROWS),
+	}
+	for name, layout := range layouts {
+		var buf bytes.Buffer
+		if err := layout.WriteJson(&buf); err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseLayout(buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: couldn't parse generated layout: %v", name, err)
+			continue
+		}
+		if len(parsed.Pixels) != len(layout.Pixels) {
+			t.Errorf("%s: wrote %v pixels, read back %v", name, len(layout.Pixels), len(parsed.Pixels))
+		}
+		for ii := range parsed.Pixels {
+			for cc := 0; cc < 3; cc++ {
+				if math.Abs(parsed.Pixels[ii].Point[cc]-layout.Pixels[ii].Point[cc]) > 0.0001 {
+					t.Errorf("%s: pixel %v is %v, read back %v", name, ii, layout.Pixels[ii].Point, parsed.Pixels[ii].Point)
+				}
+			}
+		}
+	}
+}
+
+func TestShapeLayouts(t *testing.T) {
+	// vertical circles stand up in the x-z plane
+	for _, pixel := range MakeCircleLayout(2, 12, true).Pixels {
+		if pixel.Point[1] != 0 || math.Abs(math.Hypot(pixel.Point[0], pixel.Point[2])-2) > 1e-9 {
+			t.Errorf("vertical circle has point %v", pixel.Point)
+		}
+	}
+
+	// cylinders go from bottom to top, and zigzag reverses every other ring
+	cylinder := MakeCylinderLayout(1, 2, 4, 3, true)
+	if len(cylinder.Pixels) != 12 || cylinder.Pixels[0].Point[2] != -1 || cylinder.Pixels[11].Point[2] != 1 {
+		t.Errorf("cylinder = %v", cylinder.Pixels)
+	}
+	if cylinder.Pixels[5].Point[0] >= 0 || cylinder.Pixels[1].Point[0] <= 0 {
+		t.Errorf("second ring of zigzag cylinder should go counterclockwise")
+	}
+
+	// helix ends
+	helix := MakeHelixLayout(1, 4, 9, 2)
+	if helix.Pixels[0].Point != [3]float64{0, 1, -2} || math.Abs(helix.Pixels[8].Point[1]-1) > 1e-9 || helix.Pixels[8].Point[2] != 2 {
+		t.Errorf("helix ends at %v and %v", helix.Pixels[0].Point, helix.Pixels[8].Point)
+	}
+
+	// grid wiring
+	grids := map[string][][3]float64{
+		WIRING_ROWS:           {{-1, 0, 1}, {1, 0, 1}, {-1, 0, -1}, {1, 0, -1}},
+		WIRING_ZIGZAG_ROWS:    {{-1, 0, 1}, {1, 0, 1}, {1, 0, -1}, {-1, 0, -1}},
+		WIRING_COLUMNS:        {{-1, 0, 1}, {-1, 0, -1}, {1, 0, 1}, {1, 0, -1}},
+		WIRING_ZIGZAG_COLUMNS: {{-1, 0, 1}, {-1, 0, -1}, {1, 0, -1}, {1, 0, 1}},
+	}
+	for wiring, want := range grids {
+		grid := MakeGridLayout(2, 2, 2, 2, wiring)
+		for ii := range want {
+			if grid.Pixels[ii].Point != want[ii] {
+				t.Errorf("%s grid pixel %v = %v, want %v", wiring, ii, grid.Pixels[ii].Point, want[ii])
+			}
+		}
+	}
+
+	// repeating
+	circle := MakeCircleLayout(1, 3, false)
+	circle.Repeat(2)
+	if len(circle.Pixels) != 6 || circle.Pixels[4].Point != circle.Pixels[1].Point {
+		t.Errorf("repeated circle = %v", circle.Pixels)
+	}
+
+	// reversing
+	grid := MakeGridLayout(2, 2, 2, 2, WIRING_ROWS)
+	grid.Reverse()
+	if grid.Pixels[0].Point != [3]float64{1, 0, -1} || grid.Pixels[3].Point != [3]float64{-1, 0, 1} {
+		t.Errorf("reversed grid = %v", grid.Pixels)
+	}
+
+	// groups and strips follow their pixels
+	grid = MakeGridLayout(2, 2, 2, 2, WIRING_ROWS)
+	grid.Groups["corner"] = []PixelRange{{0, 1}}
+	grid.Formats["corner"] = PixelFormat{ColorOrder: "GRB", WhiteBalance: [3]float64{1, 1, 1}}
+	grid.Strips = []LayoutStrip{{Name: "first", PixelRange: PixelRange{0, 3}}, {Name: "second", PixelRange: PixelRange{3, 1}}}
+	grid.Reverse()
+	if grid.Groups["corner"][0] != (PixelRange{3, 1}) || grid.Formats["corner"].ColorOrder != "GRB" {
+		t.Errorf("reversed groups = %v, formats = %v", grid.Groups, grid.Formats)
+	}
+	if len(grid.Strips) != 2 ||
+		grid.Strips[0].Name != "second" || grid.Strips[0].PixelRange != (PixelRange{0, 1}) ||
+		grid.Strips[1].Name != "first" || grid.Strips[1].PixelRange != (PixelRange{1, 3}) {
+		t.Errorf("reversed strips = %v", grid.Strips)
+	}
+}
+
+//================================================================================
+// COMPOSITE LAYOUTS
+
+func TestTransformPoint(t *testing.T) {
+	cases := []struct {
+		point, scale, rotate, translate, want [3]float64
+	}{
+		{[3]float64{1, 0, 0}, [3]float64{1, 1, 1}, [3]float64{0, 0, 90}, [3]float64{0, 0, 0}, [3]float64{0, 1, 0}},
+		{[3]float64{0, 1, 0}, [3]float64{1, 1, 1}, [3]float64{90, 0, 0}, [3]float64{0, 0, 0}, [3]float64{0, 0, 1}},
+		{[3]float64{0, 0, 1}, [3]float64{1, 1, 1}, [3]float64{0, 90, 0}, [3]float64{0, 0, 0}, [3]float64{1, 0, 0}},
+		{[3]float64{1, 2, 3}, [3]float64{2, 2, 2}, [3]float64{0, 0, 0}, [3]float64{1, 1, 1}, [3]float64{3, 5, 7}},
+		// scale, then rotate, then translate
+		{[3]float64{1, 0, 0}, [3]float64{3, 1, 1}, [3]float64{0, 0, 90}, [3]float64{0, 0, 5}, [3]float64{0, 3, 5}},
+	}
+	for _, c := range cases {
+		got := transformPoint(c.point, c.scale, c.rotate, c.translate)
+		for ii := range got {
+			if math.Abs(got[ii]-c.want[ii]) > 1e-9 {
+				t.Errorf("transformPoint(%v, %v, %v, %v) = %v, want %v", c.point, c.scale, c.rotate, c.translate, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+// Write the files to a temp dir and return its name.
+func writeTestLayouts(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fn, contents := range files {
+		fn = filepath.Join(dir, fn)
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCompositeLayout(t *testing.T) {
+	dir := writeTestLayouts(t, map[string]string{
+		"fixtures/pair.json": `{
+			"pixels": [{"point": [1, 0, 0]}, {"point": [2, 0, 0]}],
+			"groups": {"tip": [{"first": 1, "count": 1}]},
+			"strips": [{"name": "pair", "first": 0, "count": 2, "backing": "white"}]
+		}`,
+		"fixtures/single.json": `[{"point": [0, 0, 1]}]`,
+		"show.json": `{
+			"fixtures": [
+				{"name": "a", "layout": "fixtures/pair.json"},
+				{"name": "b", "layout": "fixtures/pair.json", "translate": [0, 0, 10], "rotate": [0, 0, 90], "scale": 2},
+				{"layout": "fixtures/single.json", "scale": [1, 1, 3]}
+			],
+			"groups": {"all": [{"first": 0, "count": 5}]}
+		}`,
+		"nested.json":   `{"fixtures": [{"layout": "show.json", "translate": [1, 1, 1]}, {"layout": "show.json"}]}`,
+		"loop.json":     `{"fixtures": [{"layout": "loop.json"}]}`,
+		"both.json":     `{"pixels": [{"point": [0, 0, 0]}], "fixtures": [{"layout": "fixtures/single.json"}]}`,
+		"missing.json":  `{"fixtures": [{"layout": "nope.json"}]}`,
+		"badscale.json": `{"fixtures": [{"layout": "fixtures/single.json", "scale": [1, 2]}]}`,
+	})
+	defer os.RemoveAll(dir)
+
+	layout, err := ReadLayout(filepath.Join(dir, "show.json"))
+	if err != nil {
+		t.Fatalf("ReadLayout failed: %v", err)
+	}
+	want := [][3]float64{{1, 0, 0}, {2, 0, 0}, {0, 2, 10}, {0, 4, 10}, {0, 0, 3}}
+	if len(layout.Pixels) != len(want) {
+		t.Fatalf("composite has %v pixels, want %v", len(layout.Pixels), len(want))
+	}
+	for ii := range want {
+		for cc := 0; cc < 3; cc++ {
+			if math.Abs(layout.Pixels[ii].Point[cc]-want[ii][cc]) > 1e-9 {
+				t.Errorf("pixel %v = %v, want %v", ii, layout.Pixels[ii].Point, want[ii])
+				break
+			}
+		}
+	}
+
+	// groups and strips from the fixtures are offset, and named fixtures become groups
+	wantGroups := map[string][]PixelRange{
+		"tip": {{1, 1}, {3, 1}},
+		"a":   {{0, 2}},
+		"b":   {{2, 2}},
+		"all": {{0, 5}},
+	}
+	if len(layout.Groups) != len(wantGroups) {
+		t.Errorf("groups = %v, want %v", layout.Groups, wantGroups)
+	}
+	for name, pixelRanges := range wantGroups {
+		got := layout.Groups[name]
+		if len(got) != len(pixelRanges) {
+			t.Errorf("group %q = %v, want %v", name, got, pixelRanges)
+			continue
+		}
+		for ii := range got {
+			if got[ii] != pixelRanges[ii] {
+				t.Errorf("group %q = %v, want %v", name, got, pixelRanges)
+			}
+		}
+	}
+	if len(layout.Strips) != 2 || layout.Strips[1].First != 2 || layout.StripForPixel(3).StringAttribute("backing") != "white" {
+		t.Errorf("strips = %v", layout.Strips)
+	}
+
+	// composites can contain composites
+	nested, err := ReadLayout(filepath.Join(dir, "nested.json"))
+	if err != nil {
+		t.Fatalf("ReadLayout(nested) failed: %v", err)
+	}
+	if len(nested.Pixels) != 10 || nested.Pixels[0].Point != [3]float64{2, 1, 1} || nested.Pixels[5].Point != [3]float64{1, 0, 0} {
+		t.Errorf("nested composite = %v", nested.Pixels)
+	}
+
+	for _, fn := range []string{"loop.json", "both.json", "missing.json", "badscale.json"} {
+		if _, err := ReadLayout(filepath.Join(dir, fn)); err == nil {
+			t.Errorf("ReadLayout(%s) should have failed", fn)
+		}
+	}
+}
+
+func TestLayoutSubset(t *testing.T) {
+	layout, err := ParseLayout([]byte(`{
+		"pixels": [{"point": [0, 0, 0]}, {"point": [1, 0, 0]}, {"point": [2, 0, 0]}, {"point": [3, 0, 0]}, {"point": [4, 0, 0]}],
+		"groups": {"ends": [{"first": 0, "count": 1}, {"first": 4, "count": 1}], "middle": [{"first": 1, "count": 3}]},
+		"strips": [{"name": "a", "first": 0, "count": 2}, {"name": "b", "first": 2, "count": 3, "backing": "white"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subset := layout.Subset(PixelRange{1, 3}, false)
+	if len(subset.Pixels) != 3 || subset.Pixels[0].Point[0] != 1 || subset.Pixels[2].Point[0] != 3 {
+		t.Errorf("subset pixels = %v", subset.Pixels)
+	}
+	if _, ok := subset.Groups["ends"]; ok {
+		t.Errorf("subset kept a group which is outside it: %v", subset.Groups)
+	}
+	if r := subset.Groups["middle"]; len(r) != 1 || r[0] != (PixelRange{0, 3}) {
+		t.Errorf("subset middle group = %v", r)
+	}
+	if len(subset.Strips) != 2 || subset.Strips[0].PixelRange != (PixelRange{0, 1}) || subset.Strips[1].PixelRange != (PixelRange{1, 2}) {
+		t.Errorf("subset strips = %v", subset.Strips)
+	}
+
+	reversed := layout.Subset(PixelRange{1, 4}, true)
+	if len(reversed.Pixels) != 4 || reversed.Pixels[0].Point[0] != 4 || reversed.Pixels[3].Point[0] != 1 {
+		t.Errorf("reversed pixels = %v", reversed.Pixels)
+	}
+	if r := reversed.Groups["ends"]; len(r) != 1 || r[0] != (PixelRange{0, 1}) {
+		t.Errorf("reversed ends group = %v", r)
+	}
+	// strip b comes first now
+	if len(reversed.Strips) != 2 || reversed.Strips[0].Name != "b" || reversed.Strips[0].PixelRange != (PixelRange{0, 3}) ||
+		reversed.Strips[1].PixelRange != (PixelRange{3, 1}) || reversed.StripForPixel(0).StringAttribute("backing") != "white" {
+		t.Errorf("reversed strips = %v", reversed.Strips)
+	}
+}
+
+func TestLayoutHash(t *testing.T) {
+	layout, err := ParseLayout([]byte(`[{"point": [0, 0, 0]}, {"point": [1, 0, 0]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, _ := ParseLayout([]byte(`{"pixels": [{"point": [0, 0, 0], "color": "red"}, {"point": [1, 0, 0]}]}`))
+	moved, _ := ParseLayout([]byte(`[{"point": [0, 0, 0]}, {"point": [1, 0, 0.001]}]`))
+	shorter, _ := ParseLayout([]byte(`[{"point": [0, 0, 0]}]`))
+	if layout.Hash() != same.Hash() {
+		t.Errorf("layouts with the same points should have the same hash")
+	}
+	if layout.Hash() == moved.Hash() || layout.Hash() == shorter.Hash() {
+		t.Errorf("layouts with different points should have different hashes")
+	}
+}
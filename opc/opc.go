@@ -5,13 +5,17 @@ package opc
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
-	"math"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -44,6 +48,17 @@ func init() {
 	}
 }
 
+//--------------------------------------------------------------------------------
+// EFFECT REGISTRY
+
+// Effects modify the pixels coming out of a source before they're sent anywhere.
+// Any number of them can be chained together in any order.
+var EFFECT_REGISTRY = map[string](func(layout *Layout) ByteThread){
+	"fader":   MakeEffectFader,
+	"gamma":   MakeEffectGamma,
+	"limiter": MakeEffectLimiter,
+}
+
 //--------------------------------------------------------------------------------
 // TYPES
 
@@ -66,7 +81,7 @@ type ByteThread func(chan []byte, chan []byte, *midi.MidiState)
 // How many bytes can be written to the SPI bus at once?
 const SPI_CHUNK_SIZE = 2048
 
-// Gamma for LPD chipset
+// Gamma for our LEDs
 const GAMMA = 2.2
 
 const CONNECTION_TRIES = 1     // milliseconds
@@ -74,34 +89,127 @@ const WAIT_TO_RETRY = 1000     // milliseconds
 const WAIT_BETWEEN_RETRIES = 1 // milliseconds
 
 //--------------------------------------------------------------------------------
-// OPC LAYOUT FORMAT
+// OPC CHANNEL MAP
 
-// Read locations from OPC-style JSON layout file into a slice of floats
-func ReadLocations(fn string) []float64 {
-	locations := make([]float64, 0)
-	var file *os.File
-	var err error
-	if file, err = os.Open(fn); err != nil {
-		panic(fmt.Sprintf("[opc.ReadLocations] could not open layout file: %s", fn))
+// A run of consecutive pixels within a frame.
+type PixelRange struct {
+	First int `json:"first"` // index of the first pixel
+	Count int `json:"count"` // number of pixels
+}
+
+// Which range of the frame each OPC channel writes into.
+// Channel 0 is the broadcast channel and always covers the whole frame, so it never appears here.
+type ChannelMap map[byte]PixelRange
+
+// Read a channel map from a JSON file which lives alongside the layout file, like this:
+//
+//	[
+//	  {"channel": 1, "first": 0, "count": 160},
+//	  {"channel": 2, "first": 160, "count": 320}
+//	]
+//
+// Return an error if the file can't be parsed or any range falls outside of nPixels.
+func ReadChannelMap(fn string, nPixels int) (ChannelMap, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 || line[0] == '[' || line[0] == ']' {
-			continue
+	var entries []struct {
+		Channel int `json:"channel"`
+		PixelRange
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	channelMap := make(ChannelMap)
+	for _, entry := range entries {
+		if entry.Channel < 1 || entry.Channel > 255 {
+			return nil, fmt.Errorf("%s: channel %v should be between 1 and 255", fn, entry.Channel)
+		}
+		if _, ok := channelMap[byte(entry.Channel)]; ok {
+			return nil, fmt.Errorf("%s: channel %v appears more than once", fn, entry.Channel)
+		}
+		if entry.First < 0 || entry.Count < 1 || entry.First+entry.Count > nPixels {
+			return nil, fmt.Errorf("%s: channel %v covers pixels %v to %v but the layout only has %v pixels",
+				fn, entry.Channel, entry.First, entry.First+entry.Count-1, nPixels)
+		}
+		channelMap[byte(entry.Channel)] = entry.PixelRange
+	}
+	fmt.Printf("[opc.ReadChannelMap] Read %v channels from %s\n", len(channelMap), fn)
+	return channelMap, nil
+}
+
+// Paint the pixels from a set-pixels message into the frame, whose length never changes.
+// Channel 0 covers the whole frame, and if the message has a different number of pixels
+// it's made to fit according to resizePolicy.
+// Other channels overwrite just their own range according to channelMap; any pixels past
+// the end of the range (or the frame) are dropped.
+// Messages for channels which aren't in the map are ignored.
+// Return false if the message was ignored.
+func compositeOpcMessage(frame []byte, opcMessage *OpcMessage, channelMap ChannelMap, resizePolicy string) bool {
+	if opcMessage.Channel == 0 {
+		fitPixels(frame, opcMessage.Bytes, resizePolicy)
+		return true
+	}
+	pixelRange, ok := channelMap[opcMessage.Channel]
+	if !ok {
+		return false
+	}
+	data := opcMessage.Bytes
+	if len(data) > pixelRange.Count*3 {
+		data = data[:pixelRange.Count*3]
+	}
+	if start := pixelRange.First * 3; start < len(frame) {
+		copy(frame[start:], data)
+	}
+	return true
+}
+
+//--------------------------------------------------------------------------------
+// PIXEL COUNT MISMATCHES
+
+// What to do when incoming pixels don't match the number of pixels in the layout
+const (
+	RESIZE_ZERO_PAD = "zero-pad" // fill in missing pixels with black; drop extra pixels
+	RESIZE_TRUNCATE = "truncate" // leave missing pixels as they were; drop extra pixels
+	RESIZE_REPEAT   = "repeat"   // tile the incoming pixels over and over to fill the frame
+	RESIZE_RESCALE  = "rescale"  // stretch or squash the incoming pixels to fit, nearest-neighbour style
+)
+
+// Copy the pixels from data into frame, using resizePolicy to deal with any difference in length.
+// Any partial pixel at the end of data is ignored.
+func fitPixels(frame []byte, data []byte, resizePolicy string) {
+	nPixelsIn := len(data) / 3
+	nPixelsOut := len(frame) / 3
+	if nPixelsIn == nPixelsOut || resizePolicy == RESIZE_TRUNCATE {
+		copy(frame, data[:nPixelsIn*3])
+		return
+	}
+	for ii := 0; ii < nPixelsOut; ii++ {
+		// choose which incoming pixel goes here, or -1 for black
+		source := -1
+		switch resizePolicy {
+		case RESIZE_REPEAT:
+			if nPixelsIn > 0 {
+				source = ii % nPixelsIn
+			}
+		case RESIZE_RESCALE:
+			if nPixelsIn > 0 {
+				source = ii * nPixelsIn / nPixelsOut
+			}
+		default:
+			if ii < nPixelsIn {
+				source = ii
+			}
+		}
+		if source == -1 {
+			frame[ii*3+0] = 0
+			frame[ii*3+1] = 0
+			frame[ii*3+2] = 0
+		} else {
+			copy(frame[ii*3:ii*3+3], data[source*3:source*3+3])
 		}
-		line = strings.Split(line, "[")[1]
-		line = strings.Split(line, "]")[0]
-		coordStrings := strings.Split(line, ", ")
-		var x, y, z float64
-		x, err = strconv.ParseFloat(coordStrings[0], 64)
-		y, err = strconv.ParseFloat(coordStrings[1], 64)
-		z, err = strconv.ParseFloat(coordStrings[2], 64)
-		locations = append(locations, x, y, z)
 	}
-	fmt.Printf("[opc.ReadLocations] Read %v pixel locations from %s\n", len(locations), fn)
-	return locations
 }
 
 //--------------------------------------------------------------------------------
@@ -165,141 +273,49 @@ func MakeSendToScreenThread() ByteThread {
 	}
 }
 
-// Return a ByteThread which writes bytes to SPI via the given filename (such as "/dev/spidev1.0").
-// Format the outgoing bytes for LED strips which use the LPD8806 chipset.
-// If the SPI device can't be opened, exit the whole program with exit status 1.
-// This chipset expects colors in G R B order; this function is responsible for swapping from
-// the usual R G B order.
-func MakeSendToLPD8806Thread(spiFn string) ByteThread {
-	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
-		fmt.Println("[opc.SendToLPD8806Thread] starting up")
-
-		// open output file and keep the file descriptor around
-		spiFile, err := os.Create(spiFn)
-		if err != nil {
-			fmt.Println("[opc.SendToLPD8806Thread] Error opening SPI file:")
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		// close spiFile on exit and check for its returned error
-		defer func() {
-			if err := spiFile.Close(); err != nil {
-				panic(err)
-			}
-		}()
-
-		gamma_lookup := make([]byte, 256)
-		for ii := 0; ii < 256; ii++ {
-			floatVal := math.Pow(float64(ii)/255, GAMMA)
-			if floatVal >= 1 {
-				gamma_lookup[ii] = 255
-			} else {
-				gamma_lookup[ii] = byte(floatVal * 256)
-			}
-		}
-
-		// as we get byte slices over the channel...
-		for bytes := range bytesIn {
-			// build a new slice of bytes in the format the LED strand wants
-			// TODO: avoid allocating these bytes over and over
-			spiBytes := make([]byte, 0)
-
-			// leading zeros to begin a new frame of bytes
-			numZeroes := (len(bytes)+31)/32 + 2
-			for ii := 0; ii < numZeroes*5; ii++ {
-				spiBytes = append(spiBytes, 0)
-			}
-
-			// actual bytes
-			//for _, v := range bytes {
-			for ii := 0; ii < len(bytes)-2; ii += 3 {
-				// apply gamma lookup table
-				r := gamma_lookup[bytes[ii+0]]
-				g := gamma_lookup[bytes[ii+1]]
-				b := gamma_lookup[bytes[ii+2]]
-
-				// HACK
-				// white balance for the strips with white backing
-				// red needs a boost
-				// green and blue are too strong
-				if ii >= 160*3 {
-					//r = byte(math.Pow(float64(r)/256.0, 0.7) * 256.0)
-					g = byte(float64(g) * 0.8)
-					b = byte(float64(b) * 0.7)
-				}
-
-				// format for LPD8806
-				// high bit must be always on, remaining seven bits are data
-				r = 128 | (r >> 1)
-				g = 128 | (g >> 1)
-				b = 128 | (b >> 1)
-				// swap to [g r b] order
-				if ii < 160*3 {
-					// copper-colored strip
-					spiBytes = append(spiBytes, g)
-					spiBytes = append(spiBytes, r)
-					spiBytes = append(spiBytes, b)
-				} else {
-					// white strips
-					spiBytes = append(spiBytes, b)
-					spiBytes = append(spiBytes, r)
-					spiBytes = append(spiBytes, g)
-				}
-			}
-
-			// send some extra black pixels to make the last LEDs latch
-			for ii := 0; ii < 6; ii++ {
-				spiBytes = append(spiBytes, 128)
-			}
-
-			// write spiBytes to the wire in chunks
-			//fmt.Println("sending", len(bytes), " + ", numZeroes, " zeroes = ", len(spiBytes), "bytes")
-			bytesSent := 0
-			for ii := 0; ii < len(spiBytes); ii += SPI_CHUNK_SIZE {
-				endIndex := ii + SPI_CHUNK_SIZE
-				if endIndex > len(spiBytes) {
-					endIndex = len(spiBytes)
-				}
-				thisChunk := spiBytes[ii:endIndex]
-				bytesSent += len(thisChunk)
-				if _, err := spiFile.Write(thisChunk); err != nil {
-					panic(err)
-				}
-			}
-			//fmt.Println(bytesSent,len(spiBytes))
-
-			bytesOut <- bytes
-		}
-	}
-}
-
 // Return a ByteThread which sends the bytes out as OPC messages to the given ipPort.
 // Create OPC headers for each byte slice it sends.
 // Initiate and maintains a long-lived connection to ipPort.  If the connection is bad at any point
 // (or was never good to begin with), keep trying to reconnect whenever new bytes come in.
 // Can sleep for WAIT_TO_RETRY during reconnection attempts; this blocks the input channel.
 // Silently drop bytes if it's not possible to send them.
-func MakeSendToOpcThread(ipPort string) ByteThread {
+// Any sysexMessages are sent each time a new connection is made, before any pixels;
+// use these to configure the server (for example, with MakeFadecandyColorCorrectionMessage).
+func MakeSendToOpcThread(ipPort string, sysexMessages ...*OpcMessage) ByteThread {
+	return MakeSendToOpcChannelThread(ipPort, 0, nil, sysexMessages...)
+}
+
+// Like MakeSendToOpcThread, but send the pixels on the given OPC channel instead of channel 0,
+// and adjust them according to pixelFormats (see pixel-format.go).  Pixels past the end of
+// pixelFormats use DEFAULT_PIXEL_FORMAT, and OPC's usual color order is RGB.
+// If a color order is invalid, exit the whole program with exit status 1.
+func MakeSendToOpcChannelThread(ipPort string, channel byte, pixelFormats []PixelFormat, sysexMessages ...*OpcMessage) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 		fmt.Println("[opc.SendToOpcThread] starting up")
 
 		var conn net.Conn
 		var err error
 
-		gamma_lookup := make([]byte, 256)
-		for ii := 0; ii < 256; ii++ {
-			floatVal := math.Pow(float64(ii)/255, GAMMA)
-			if floatVal >= 1 {
-				gamma_lookup[ii] = 255
-			} else {
-				gamma_lookup[ii] = byte(floatVal * 256)
-			}
+		formatter, err := newPixelFormatter("RGB", pixelFormats)
+		if err != nil {
+			fmt.Println("[opc.SendToOpcThread] Error:", err)
+			os.Exit(1)
 		}
 
 		for bytes := range bytesIn {
 			// if the connection has gone bad, make a new one
 			if conn == nil {
 				conn = getConnection(ipPort)
+				// configure the server on the new connection
+				for _, opcMessage := range sysexMessages {
+					if conn == nil {
+						break
+					}
+					if _, err = conn.Write(opcMessage.Encode()); err != nil {
+						fmt.Println("[opc.SendToOpcThread]", err)
+						conn = nil
+					}
+				}
 			}
 			// if that didn't work, wait a second and restart the loop
 			if conn == nil {
@@ -311,15 +327,12 @@ func MakeSendToOpcThread(ipPort string) ByteThread {
 
 			// ok, at this point the connection is good
 
-			// gamma correct
+			// gamma correct and format
 			// HACK: change this later when we decide if OPC should have
 			// pixels in perceptual or linear space
-			for ii := range bytes {
-				bytes[ii] = gamma_lookup[bytes[ii+0]]
-			}
+			formatter.formatBytes(bytes, bytes)
 
 			// make and send OPC header
-			channel := byte(0)
 			command := byte(0)
 			lenLowByte := byte(len(bytes) % 256)
 			lenHighByte := byte(len(bytes) / 256)
@@ -348,50 +361,181 @@ func MakeSendToOpcThread(ipPort string) ByteThread {
 }
 
 //--------------------------------------------------------------------------------
-// OPC SERVER
+// OPC MESSAGES
+
+// OPC protocol:
+// byte 0: channel number
+// byte 1: command
+// byte 2: length (high byte)
+// byte 3: length (low byte)
+// bytes 4...: data in R G B order
+const OPC_HEADER_LEN = 4
+
+// OPC commands
+const (
+	OPC_SET_PIXELS byte = 0x00
+	OPC_SYSEX      byte = 0xff // system exclusive; data begins with a 2-byte system ID
+)
 
 // A single OPC message
 type OpcMessage struct {
 	Channel byte
 	Command byte
 	Bytes   []byte
+	Client  string // address of the client which sent this message
 }
 
-// Read a series of OPC messages as bytes from the net connection, convert them into OpcMessage
-// objects, and push pointers to those objects over the channel.
-func handleOpcConnection(conn net.Conn, incomingOpcMessageChan chan *OpcMessage) {
-	// OPC protocol:
-	// byte 0: channel number
-	// byte 1: command
-	// byte 2: length (high byte)
-	// byte 3: length (low byte)
-	// bytes 4...: data in R G B order
-	for {
-		// get header
-		headerBuf := make([]byte, 4)
-		n, err := conn.Read(headerBuf)
-		if err != nil {
-			return // err is EOF hopefully
+// Convert the message to bytes, header and all, ready to go over the wire.
+func (opcMessage *OpcMessage) Encode() []byte {
+	length := len(opcMessage.Bytes)
+	result := make([]byte, OPC_HEADER_LEN, OPC_HEADER_LEN+length)
+	result[0] = opcMessage.Channel
+	result[1] = opcMessage.Command
+	result[2] = byte(length / 256)
+	result[3] = byte(length % 256)
+	return append(result, opcMessage.Bytes...)
+}
+
+//--------------------------------------------------------------------------------
+// OPC SYSTEM EXCLUSIVE
+
+// Settings which clients have sent to one OPC server source with system exclusive messages.
+// Each server has its own, which is only touched from the goroutine that receives its messages.
+type OpcServerState struct {
+	fadecandyColorLookup [][]byte // one lookup table for each of r, g, b; nil until a client sets it
+}
+
+// Handles the data from a system exclusive message, after the 2-byte system ID.
+// server is the state of the server which received the message.
+type SysexHandler func(server *OpcServerState, opcMessage *OpcMessage, data []byte)
+
+// Sysex handlers by system ID.
+// Handlers for an OPC server source all run in the goroutine which receives its messages.
+var SYSEX_HANDLERS = make(map[uint16]SysexHandler)
+
+// Handle system exclusive messages with the given system ID using handler.
+// Call this before starting any OPC servers.
+func RegisterSysexHandler(systemId uint16, handler SysexHandler) {
+	SYSEX_HANDLERS[systemId] = handler
+}
+
+// Make a system exclusive message for the given system ID.
+func MakeSysexMessage(systemId uint16, data []byte) *OpcMessage {
+	bytes := []byte{byte(systemId >> 8), byte(systemId & 0xff)}
+	return &OpcMessage{Channel: 0, Command: OPC_SYSEX, Bytes: append(bytes, data...)}
+}
+
+// Pass a system exclusive message on to the handler for its system ID.
+// Messages which are too short or have no handler are ignored.
+func dispatchSysexMessage(server *OpcServerState, opcMessage *OpcMessage) {
+	if len(opcMessage.Bytes) < 2 {
+		fmt.Printf("[opc.dispatchSysexMessage] sysex message from %v is too short\n", opcMessage.Client)
+		return
+	}
+	systemId := uint16(opcMessage.Bytes[0])<<8 + uint16(opcMessage.Bytes[1])
+	handler, ok := SYSEX_HANDLERS[systemId]
+	if !ok {
+		fmt.Printf("[opc.dispatchSysexMessage] no handler for system ID %#04x from %v\n", systemId, opcMessage.Client)
+		return
+	}
+	handler(server, opcMessage, opcMessage.Bytes[2:])
+}
+
+//--------------------------------------------------------------------------------
+// OPC SERVER
+
+// Per-connection state for one OPC client connected to the server.
+type opcClient struct {
+	conn      net.Conn
+	addr      string
+	nMessages int
+}
+
+// Keeps track of the clients which are currently connected to an OPC server.
+type opcClientList struct {
+	mutex   sync.Mutex
+	clients map[*opcClient]bool
+}
+
+func (cl *opcClientList) add(client *opcClient) int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	cl.clients[client] = true
+	return len(cl.clients)
+}
+
+func (cl *opcClientList) remove(client *opcClient) int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	delete(cl.clients, client)
+	return len(cl.clients)
+}
+
+// Read one whole OPC message from the reader.
+// TCP is free to split a message across any number of reads, so this keeps reading
+// until the complete header and payload have arrived.
+// Return io.EOF if the stream ended cleanly between messages, or io.ErrUnexpectedEOF
+// if it ended partway through a message.
+func readOpcMessage(reader io.Reader) (*OpcMessage, error) {
+	headerBuf := make([]byte, OPC_HEADER_LEN)
+	if _, err := io.ReadFull(reader, headerBuf); err != nil {
+		return nil, err
+	}
+	channel := headerBuf[0]
+	command := headerBuf[1]
+	length := int(headerBuf[2])<<8 + int(headerBuf[3])
+
+	// get data.  a zero-length message is legal and has no payload to read.
+	dataBuf := make([]byte, length)
+	if _, err := io.ReadFull(reader, dataBuf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		if n != 4 {
-			panic(fmt.Sprintf("header should be 4 bytes long, got %v", n))
+		return nil, err
+	}
+	return &OpcMessage{Channel: channel, Command: command, Bytes: dataBuf}, nil
+}
+
+// Read a series of OPC messages as bytes from the client's net connection, convert them into
+// OpcMessage objects, and push pointers to those objects over the channel.
+// Return when the client disconnects or sends something we can't parse; in either case
+// the connection is closed but the rest of the server keeps running.
+func handleOpcConnection(client *opcClient, incomingOpcMessageChan chan *OpcMessage) {
+	defer client.conn.Close()
+	reader := bufio.NewReader(client.conn)
+	for {
+		opcMessage, err := readOpcMessage(reader)
+		if err == io.EOF {
+			fmt.Printf("[opc.handleOpcConnection] %v disconnected after %v messages\n", client.addr, client.nMessages)
+			return
 		}
-		channel := headerBuf[0]
-		command := headerBuf[1]
-		length := int(headerBuf[2])<<8 + int(headerBuf[3])
-
-		// get data
-		dataBuf := make([]byte, length)
-		// TODO: test this with length == 0
-		n, err = conn.Read(dataBuf)
 		if err != nil {
-			panic(err)
-		}
-		if n != length {
-			panic(fmt.Sprintf("expected %v bytes of data, got %v", length, n))
+			fmt.Printf("[opc.handleOpcConnection] dropping %v after %v messages: %v\n", client.addr, client.nMessages, err)
+			return
 		}
+		client.nMessages += 1
+		opcMessage.Client = client.addr
+		incomingOpcMessageChan <- opcMessage
+	}
+}
 
-		incomingOpcMessageChan <- &OpcMessage{channel, command, dataBuf}
+// Accept connections from the listener and handle each client in its own goroutine,
+// so any number of OPC clients can be connected at once.
+// Return when the listener is closed.
+func serveOpc(listener net.Listener, incomingOpcMessageChan chan *OpcMessage) error {
+	clientList := &opcClientList{clients: make(map[*opcClient]bool)}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		client := &opcClient{conn: conn, addr: conn.RemoteAddr().String()}
+		nClients := clientList.add(client)
+		fmt.Printf("[opc.serveOpc] %v connected (%v clients)\n", client.addr, nClients)
+		go func() {
+			handleOpcConnection(client, incomingOpcMessageChan)
+			fmt.Printf("[opc.serveOpc] %v clients connected\n", clientList.remove(client))
+		}()
 	}
 }
 
@@ -400,16 +544,48 @@ func handleOpcConnection(conn net.Conn, incomingOpcMessageChan chan *OpcMessage)
 // You should launch this in its own goroutine.
 func OpcServerThread(ipPort string, incomingOpcMessageChan chan *OpcMessage) {
 	fmt.Println("[opc] OPC server thread is listening on", ipPort)
-	listen, err := net.Listen("tcp", ":7890")
+	listen, err := net.Listen("tcp", ipPort)
 	if err != nil {
 		panic(err)
 	}
+	if err := serveOpc(listen, incomingOpcMessageChan); err != nil {
+		panic(err)
+	}
+}
+
+// Read OPC messages from a UDP socket, one message per datagram, and push them over
+// the channel.  Datagrams which are too short to hold their own header or payload
+// are dropped.  Any bytes after the end of the message are ignored.
+// Return when the socket is closed.
+func serveOpcUdp(packetConn net.PacketConn, incomingOpcMessageChan chan *OpcMessage) error {
+	// largest possible OPC message
+	datagramBuf := make([]byte, OPC_HEADER_LEN+65535)
 	for {
-		conn, err := listen.Accept()
+		n, addr, err := packetConn.ReadFrom(datagramBuf)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		go handleOpcConnection(conn, incomingOpcMessageChan)
+		opcMessage, err := readOpcMessage(bytes.NewReader(datagramBuf[:n]))
+		if err != nil {
+			fmt.Printf("[opc.serveOpcUdp] dropping bad datagram from %v: %v\n", addr, err)
+			continue
+		}
+		opcMessage.Client = addr.String()
+		incomingOpcMessageChan <- opcMessage
+	}
+}
+
+// Like OpcServerThread, but listen for OPC messages sent as UDP datagrams.
+// There's no connection, so any number of senders can use the same port.
+// You should launch this in its own goroutine.
+func OpcUdpServerThread(ipPort string, incomingOpcMessageChan chan *OpcMessage) {
+	fmt.Println("[opc] OPC UDP server thread is listening on", ipPort)
+	packetConn, err := net.ListenPacket("udp", ipPort)
+	if err != nil {
+		panic(err)
+	}
+	if err := serveOpcUdp(packetConn, incomingOpcMessageChan); err != nil {
+		panic(err)
 	}
 }
 
@@ -421,30 +597,147 @@ func LaunchOpcServer(ipPort string) chan *OpcMessage {
 	return incomingOpcMessageChan
 }
 
+// What an OPC server source does when its clients stop sending pixels
+const (
+	HOLD_LAST_FRAME = "hold" // keep showing the last frame we got
+	FADE_TO_BLACK   = "fade" // fade the last frame to black over INPUT_FADE_TIME
+)
+
+// How long it takes to fade to black once the input has timed out
+const INPUT_FADE_TIME = 1.0 // seconds
+
+// Settings for the ByteThreads returned by MakeOpcServerThread and friends.
+type OpcSourceSettings struct {
+	ChannelMap   ChannelMap // pixel range for each OPC channel other than 0.  may be nil
+	InputTimeout float64    // seconds without any pixels before OnTimeout kicks in.  0 means never
+	OnTimeout    string     // HOLD_LAST_FRAME or FADE_TO_BLACK
+	ResizePolicy string     // one of the RESIZE_* constants, for clients who send the wrong number of pixels
+}
+
 // Return a ByteThread function which will start an OPC server and push out pixels from it in
-// the usual way ByteThreads do.  The channel field is ignored, so if you're piping OPC In to
-// OPC Out be aware that the channel will be set to zero in the process.
-// Only pays attention to OPC messages with command 0 (set pixels).
-func MakeOpcServerThread(ipPort string) ByteThread {
+// the usual way ByteThreads do.
+// The frame always has the same number of pixels as the byte slices we're given.
+// Messages on channel 0 fill the whole frame; if they have a different number of pixels they
+// are made to fit according to settings.ResizePolicy.  Messages on other channels only fill the
+// range of pixels given to that channel in settings.ChannelMap, so several OPC clients can each
+// own part of the frame.  The outgoing frame is composited from the most recent data for each
+// pixel.  If you're piping OPC In to OPC Out be aware that everything will be sent back out
+// on channel zero.
+// Messages are received in the background, so the ByteThread never waits for the network; it
+// always hands back the latest frame, which is black until the first message arrives.  If no
+// pixels arrive for settings.InputTimeout seconds, the frame is held or faded out according
+// to settings.OnTimeout.
+// Pays attention to OPC messages with command 0 (set pixels).  System exclusive messages are
+// passed on to the handlers in SYSEX_HANDLERS; by default these act like a FadeCandy server.
+// Everything else is ignored.
+func MakeOpcServerThread(ipPort string, settings OpcSourceSettings) ByteThread {
 	incomingOpcMessageChan := make(chan *OpcMessage, 0)
 	go OpcServerThread(ipPort, incomingOpcMessageChan)
+	return makeOpcMessageSourceThread(incomingOpcMessageChan, settings)
+}
+
+// Like MakeOpcServerThread, but receive OPC messages over UDP instead of TCP.
+func MakeOpcUdpServerThread(ipPort string, settings OpcSourceSettings) ByteThread {
+	incomingOpcMessageChan := make(chan *OpcMessage, 0)
+	go OpcUdpServerThread(ipPort, incomingOpcMessageChan)
+	return makeOpcMessageSourceThread(incomingOpcMessageChan, settings)
+}
+
+// The latest frame composited from incoming messages.  It's written by a receiving goroutine
+// like receiveOpcMessagesThread and read by the ByteThread which hands frames to the main loop.
+type inputFrameBuffer struct {
+	mutex         sync.Mutex
+	frame         []byte
+	lastInputTime float64 // in seconds; 0 until the first pixels arrive
+}
+
+// Read OPC messages from the channel forever and composite them into the frame buffer.
+// Sysex messages are dispatched from here, so handlers always run in this goroutine.
+func receiveOpcMessagesThread(incomingOpcMessageChan chan *OpcMessage, frameBuffer *inputFrameBuffer, settings OpcSourceSettings) {
+	nPixels := len(frameBuffer.frame) / 3
+	// how many pixels each client sent on channel 0 last time
+	clientPixelCounts := make(map[string]int)
+	server := &OpcServerState{}
+	for opcMessage := range incomingOpcMessageChan {
+		if opcMessage.Command == OPC_SYSEX {
+			dispatchSysexMessage(server, opcMessage)
+			continue
+		}
+		// otherwise only accept command 0 (set pixels)
+		if opcMessage.Command != OPC_SET_PIXELS {
+			continue
+		}
+		if opcMessage.Channel == 0 {
+			nPixelsIn := len(opcMessage.Bytes) / 3
+			lastPixelCount, seen := clientPixelCounts[opcMessage.Client]
+			if (seen && nPixelsIn != lastPixelCount) || (!seen && nPixelsIn != nPixels) {
+				fmt.Printf("[opc.OpcServerThread] %v is sending %v pixels; layout has %v (%s)\n", opcMessage.Client, nPixelsIn, nPixels, settings.ResizePolicy)
+			}
+			clientPixelCounts[opcMessage.Client] = nPixelsIn
+		}
+		server.applyFadecandyColorCorrection(opcMessage.Bytes)
+		frameBuffer.mutex.Lock()
+		if compositeOpcMessage(frameBuffer.frame, opcMessage, settings.ChannelMap, settings.ResizePolicy) {
+			frameBuffer.lastInputTime = float64(time.Now().UnixNano()) / 1.0e9
+		}
+		frameBuffer.mutex.Unlock()
+	}
+}
+
+// How bright the frame should be, given how long it's been since the last input.
+// Range 0 to 1.
+func inputTimeoutBrightness(secondsSinceInput float64, settings OpcSourceSettings) float64 {
+	if settings.InputTimeout <= 0 || settings.OnTimeout != FADE_TO_BLACK {
+		return 1
+	}
+	return 1 - colorutils.Clamp((secondsSinceInput-settings.InputTimeout)/INPUT_FADE_TIME, 0, 1)
+}
+
+// Return a ByteThread which starts receiving OPC messages from the channel in the background
+// and fills each byte slice with the most recent frame.
+func makeOpcMessageSourceThread(incomingOpcMessageChan chan *OpcMessage, settings OpcSourceSettings) ByteThread {
+	return makeInputSourceThread(func(frameBuffer *inputFrameBuffer) {
+		receiveOpcMessagesThread(incomingOpcMessageChan, frameBuffer, settings)
+	}, settings)
+}
+
+// Return a ByteThread which fills each byte slice with the most recent frame from an input.
+// The first time it's asked for a frame, it launches receive in its own goroutine with a black
+// frame buffer of the right size; receive should update the frame buffer forever.
+// Only the timeout settings matter here.
+func makeInputSourceThread(receive func(frameBuffer *inputFrameBuffer), settings OpcSourceSettings) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		var frameBuffer *inputFrameBuffer
+		lastTimedOut := false
 		// wait for ready signal from outside
 		for byteSlice := range bytesIn {
-			// wait for incoming opc message
-			opcMessage := <-incomingOpcMessageChan
-			// only accept command 0 (set pixels)
-			if opcMessage.Command != 0 {
-				continue
+			if frameBuffer == nil {
+				// start out black, at the size the outside world expects
+				frameBuffer = &inputFrameBuffer{frame: make([]byte, len(byteSlice))}
+				go receive(frameBuffer)
 			}
-			// copy opc message bytes into byteSlice and return it
-			// because byteSlice and opcMessage.Bytes might be different lengths,
-			// we reset byteSlice back to length 0 and then append all the bytes
-			// while keeping the same underlying array for efficiency.
-			byteSlice = byteSlice[0:0]
-			for _, b := range opcMessage.Bytes {
-				byteSlice = append(byteSlice, b)
+
+			// copy the frame into byteSlice and return it
+			frameBuffer.mutex.Lock()
+			copy(byteSlice, frameBuffer.frame)
+			lastInputTime := frameBuffer.lastInputTime
+			frameBuffer.mutex.Unlock()
+
+			// handle input timeout
+			if lastInputTime > 0 && settings.InputTimeout > 0 {
+				secondsSinceInput := float64(time.Now().UnixNano())/1.0e9 - lastInputTime
+				timedOut := secondsSinceInput > settings.InputTimeout
+				if timedOut && !lastTimedOut {
+					fmt.Printf("[opc.InputSourceThread] no input for %v seconds; %s\n", settings.InputTimeout, settings.OnTimeout)
+				}
+				lastTimedOut = timedOut
+				if brightness := inputTimeoutBrightness(secondsSinceInput, settings); brightness < 1 {
+					for ii := range byteSlice {
+						byteSlice[ii] = byte(float64(byteSlice[ii]) * brightness)
+					}
+				}
 			}
+
 			bytesOut <- byteSlice
 		}
 	}
@@ -0,0 +1,1760 @@
+package opc
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run "go test -update" to rewrite the golden files in testdata from the current output instead of
+// checking against them.  Look at what changed before committing them.
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+//================================================================================
+// OPC SERVER HELPERS
+
+// Start serveOpc on a loopback listener with a random port.
+// Return the listener (so the test can close it) and the channel of incoming messages.
+func startTestOpcServer(t *testing.T) (net.Listener, chan *OpcMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on loopback: %v", err)
+	}
+	incomingOpcMessageChan := make(chan *OpcMessage, 100)
+	go serveOpc(listener, incomingOpcMessageChan)
+	return listener, incomingOpcMessageChan
+}
+
+func dialTestOpcServer(t *testing.T, listener net.Listener) net.Conn {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("couldn't connect to test server: %v", err)
+	}
+	return conn
+}
+
+// Write the bytes to the connection a few at a time, pausing between writes
+// so they arrive at the server as separate TCP segments.
+func writeFragmented(t *testing.T, conn net.Conn, data []byte, fragmentSize int) {
+	for ii := 0; ii < len(data); ii += fragmentSize {
+		endIndex := ii + fragmentSize
+		if endIndex > len(data) {
+			endIndex = len(data)
+		}
+		if _, err := conn.Write(data[ii:endIndex]); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func makeOpcBytes(channel, command byte, data []byte) []byte {
+	result := []byte{channel, command, byte(len(data) / 256), byte(len(data) % 256)}
+	return append(result, data...)
+}
+
+func receiveOpcMessage(t *testing.T, ch chan *OpcMessage) *OpcMessage {
+	select {
+	case opcMessage := <-ch:
+		return opcMessage
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for OPC message")
+	}
+	return nil
+}
+
+func expectOpcMessage(t *testing.T, ch chan *OpcMessage, channel, command byte, data []byte) {
+	opcMessage := receiveOpcMessage(t, ch)
+	if opcMessage.Channel != channel || opcMessage.Command != command || !bytes.Equal(opcMessage.Bytes, data) {
+		t.Errorf("got message ch=%v cmd=%v len=%v, want ch=%v cmd=%v len=%v",
+			opcMessage.Channel, opcMessage.Command, len(opcMessage.Bytes), channel, command, len(data))
+	}
+}
+
+func expectNoOpcMessage(t *testing.T, ch chan *OpcMessage) {
+	select {
+	case opcMessage := <-ch:
+		t.Errorf("got unexpected message ch=%v cmd=%v len=%v", opcMessage.Channel, opcMessage.Command, len(opcMessage.Bytes))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func makeTestPixels(nPixels int) []byte {
+	data := make([]byte, nPixels*3)
+	for ii := range data {
+		data[ii] = byte(ii * 7)
+	}
+	return data
+}
+
+//================================================================================
+// OPC SERVER TESTS
+
+func TestOpcServerFragmented(t *testing.T) {
+	listener, ch := startTestOpcServer(t)
+	defer listener.Close()
+	conn := dialTestOpcServer(t, listener)
+	defer conn.Close()
+
+	// a large frame, split into pieces which don't line up with the header or payload
+	data := makeTestPixels(1000)
+	writeFragmented(t, conn, makeOpcBytes(0, 0, data), 777)
+	expectOpcMessage(t, ch, 0, 0, data)
+
+	// a header arriving one byte at a time
+	data = makeTestPixels(2)
+	writeFragmented(t, conn, makeOpcBytes(3, 0, data), 1)
+	expectOpcMessage(t, ch, 3, 0, data)
+}
+
+func TestOpcServerCoalesced(t *testing.T) {
+	listener, ch := startTestOpcServer(t)
+	defer listener.Close()
+	conn := dialTestOpcServer(t, listener)
+	defer conn.Close()
+
+	// several messages in a single write
+	a := makeTestPixels(10)
+	b := makeTestPixels(20)
+	stream := append(makeOpcBytes(1, 0, a), makeOpcBytes(2, 0, b)...)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expectOpcMessage(t, ch, 1, 0, a)
+	expectOpcMessage(t, ch, 2, 0, b)
+}
+
+func TestOpcServerZeroLength(t *testing.T) {
+	listener, ch := startTestOpcServer(t)
+	defer listener.Close()
+	conn := dialTestOpcServer(t, listener)
+	defer conn.Close()
+
+	data := makeTestPixels(5)
+	stream := append(makeOpcBytes(0, 0, []byte{}), makeOpcBytes(0, 0, data)...)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	expectOpcMessage(t, ch, 0, 0, []byte{})
+	expectOpcMessage(t, ch, 0, 0, data)
+}
+
+func TestOpcServerMalformed(t *testing.T) {
+	listener, ch := startTestOpcServer(t)
+	defer listener.Close()
+
+	// truncated header
+	conn := dialTestOpcServer(t, listener)
+	conn.Write([]byte{0, 0})
+	conn.Close()
+	expectNoOpcMessage(t, ch)
+
+	// header promises more data than is sent
+	conn = dialTestOpcServer(t, listener)
+	conn.Write(makeOpcBytes(0, 0, makeTestPixels(100))[:50])
+	conn.Close()
+	expectNoOpcMessage(t, ch)
+
+	// the server should still be accepting new clients
+	conn = dialTestOpcServer(t, listener)
+	defer conn.Close()
+	data := makeTestPixels(3)
+	conn.Write(makeOpcBytes(0, 0, data))
+	expectOpcMessage(t, ch, 0, 0, data)
+}
+
+func TestOpcServerMultipleClients(t *testing.T) {
+	listener, ch := startTestOpcServer(t)
+	defer listener.Close()
+
+	connA := dialTestOpcServer(t, listener)
+	defer connA.Close()
+	connB := dialTestOpcServer(t, listener)
+	defer connB.Close()
+
+	// interleave partial messages from both clients
+	a := makeTestPixels(40)
+	b := makeTestPixels(60)
+	streamA := makeOpcBytes(1, 0, a)
+	streamB := makeOpcBytes(2, 0, b)
+	connA.Write(streamA[:30])
+	connB.Write(streamB[:30])
+	time.Sleep(5 * time.Millisecond)
+	connB.Write(streamB[30:])
+	expectOpcMessage(t, ch, 2, 0, b)
+	connA.Write(streamA[30:])
+	expectOpcMessage(t, ch, 1, 0, a)
+
+	// dropping one client shouldn't affect the other
+	connA.Write([]byte{9})
+	connA.Close()
+	connB.Write(streamB)
+	opcMessage := receiveOpcMessage(t, ch)
+	if opcMessage.Channel != 2 || opcMessage.Client != connB.LocalAddr().String() {
+		t.Errorf("got message from %v on channel %v, want %v on channel 2", opcMessage.Client, opcMessage.Channel, connB.LocalAddr())
+	}
+}
+
+func TestOpcUdpServer(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on loopback: %v", err)
+	}
+	defer packetConn.Close()
+	ch := make(chan *OpcMessage, 100)
+	go serveOpcUdp(packetConn, ch)
+
+	conn, err := net.Dial("udp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("couldn't connect to test server: %v", err)
+	}
+	defer conn.Close()
+
+	// one message per datagram
+	a := makeTestPixels(300)
+	conn.Write(makeOpcBytes(0, 0, a))
+	expectOpcMessage(t, ch, 0, 0, a)
+
+	// a datagram which is shorter than its header claims is dropped
+	conn.Write(makeOpcBytes(0, 0, makeTestPixels(10))[:20])
+	expectNoOpcMessage(t, ch)
+
+	// zero-length messages are fine
+	conn.Write(makeOpcBytes(4, 0, []byte{}))
+	opcMessage := receiveOpcMessage(t, ch)
+	if opcMessage.Channel != 4 || len(opcMessage.Bytes) != 0 || opcMessage.Client != conn.LocalAddr().String() {
+		t.Errorf("got ch=%v len=%v from %v, want ch=4 len=0 from %v", opcMessage.Channel, len(opcMessage.Bytes), opcMessage.Client, conn.LocalAddr())
+	}
+}
+
+//================================================================================
+// OPC CHANNEL MAP TESTS
+
+func TestReadChannelMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "test.channels.json")
+
+	ioutil.WriteFile(fn, []byte(`[{"channel": 1, "first": 0, "count": 10}, {"channel": 2, "first": 10, "count": 5}]`), 0644)
+	channelMap, err := ReadChannelMap(fn, 15)
+	if err != nil {
+		t.Fatalf("ReadChannelMap failed: %v", err)
+	}
+	if len(channelMap) != 2 || channelMap[1] != (PixelRange{0, 10}) || channelMap[2] != (PixelRange{10, 5}) {
+		t.Errorf("ReadChannelMap = %v", channelMap)
+	}
+
+	// range past the end of the layout
+	if _, err := ReadChannelMap(fn, 14); err == nil {
+		t.Errorf("ReadChannelMap should reject ranges outside the layout")
+	}
+
+	// channel 0 can't be remapped
+	ioutil.WriteFile(fn, []byte(`[{"channel": 0, "first": 0, "count": 10}]`), 0644)
+	if _, err := ReadChannelMap(fn, 15); err == nil {
+		t.Errorf("ReadChannelMap should reject channel 0")
+	}
+}
+
+func TestCompositeOpcMessage(t *testing.T) {
+	channelMap := ChannelMap{1: {0, 2}, 2: {2, 2}}
+	frame := make([]byte, 4*3)
+
+	// channels only touch their own ranges, and extra pixels are dropped
+	compositeOpcMessage(frame, &OpcMessage{Channel: 2, Bytes: []byte{1, 1, 1, 2, 2, 2, 3, 3, 3}}, channelMap, RESIZE_ZERO_PAD)
+	compositeOpcMessage(frame, &OpcMessage{Channel: 1, Bytes: []byte{4, 4, 4}}, channelMap, RESIZE_ZERO_PAD)
+	want := []byte{4, 4, 4, 0, 0, 0, 1, 1, 1, 2, 2, 2}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("composited frame = %v, want %v", frame, want)
+	}
+
+	// unmapped channels are ignored
+	if ok := compositeOpcMessage(frame, &OpcMessage{Channel: 3, Bytes: []byte{9, 9, 9}}, channelMap, RESIZE_ZERO_PAD); ok || !bytes.Equal(frame, want) {
+		t.Errorf("unmapped channel changed the frame to %v", frame)
+	}
+
+	// channel 0 replaces everything
+	compositeOpcMessage(frame, &OpcMessage{Channel: 0, Bytes: []byte{5, 5, 5}}, nil, RESIZE_ZERO_PAD)
+	want = []byte{5, 5, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("broadcast frame = %v, want %v", frame, want)
+	}
+}
+
+func TestFitPixels(t *testing.T) {
+	cases := []struct {
+		resizePolicy string
+		data         []byte
+		want         []byte
+	}{
+		{RESIZE_ZERO_PAD, []byte{1, 1, 1, 2, 2, 2}, []byte{1, 1, 1, 2, 2, 2, 0, 0, 0, 0, 0, 0}},
+		{RESIZE_ZERO_PAD, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4, 5, 5, 5}, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4}},
+		{RESIZE_TRUNCATE, []byte{1, 1, 1, 2, 2, 2}, []byte{1, 1, 1, 2, 2, 2, 9, 9, 9, 9, 9, 9}},
+		{RESIZE_TRUNCATE, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4, 5, 5, 5}, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4}},
+		{RESIZE_REPEAT, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3}, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 1, 1, 1}},
+		{RESIZE_RESCALE, []byte{1, 1, 1, 2, 2, 2}, []byte{1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 2}},
+		{RESIZE_RESCALE, []byte{1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4, 4, 5, 5, 5, 6, 6, 6, 7, 7, 7, 8, 8, 8}, []byte{1, 1, 1, 3, 3, 3, 5, 5, 5, 7, 7, 7}},
+		// partial pixels are ignored
+		{RESIZE_TRUNCATE, []byte{1, 1, 1, 2, 2}, []byte{1, 1, 1, 9, 9, 9, 9, 9, 9, 9, 9, 9}},
+		// empty input
+		{RESIZE_REPEAT, []byte{}, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{RESIZE_RESCALE, []byte{}, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, c := range cases {
+		frame := bytes.Repeat([]byte{9}, 4*3)
+		fitPixels(frame, c.data, c.resizePolicy)
+		if !bytes.Equal(frame, c.want) {
+			t.Errorf("fitPixels(%v, %s) = %v, want %v", c.data, c.resizePolicy, frame, c.want)
+		}
+	}
+}
+
+//================================================================================
+// OPC SYSEX TESTS
+
+func TestSysexDispatch(t *testing.T) {
+	var gotData []byte
+	RegisterSysexHandler(0x1234, func(server *OpcServerState, opcMessage *OpcMessage, data []byte) {
+		gotData = data
+	})
+	defer delete(SYSEX_HANDLERS, 0x1234)
+
+	opcMessage := MakeSysexMessage(0x1234, []byte{1, 2, 3})
+	encoded := opcMessage.Encode()
+	want := []byte{0, OPC_SYSEX, 0, 5, 0x12, 0x34, 1, 2, 3}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("encoded sysex = %v, want %v", encoded, want)
+	}
+
+	// round trip through the parser and dispatch it
+	parsed, err := readOpcMessage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("readOpcMessage failed: %v", err)
+	}
+	dispatchSysexMessage(&OpcServerState{}, parsed)
+	if !bytes.Equal(gotData, []byte{1, 2, 3}) {
+		t.Errorf("handler got %v, want [1 2 3]", gotData)
+	}
+
+	// unknown system IDs and short messages don't crash
+	dispatchSysexMessage(&OpcServerState{}, MakeSysexMessage(0x4321, nil))
+	dispatchSysexMessage(&OpcServerState{}, &OpcMessage{Command: OPC_SYSEX, Bytes: []byte{1}})
+}
+
+func TestFadecandySysex(t *testing.T) {
+	server := &OpcServerState{}
+
+	// firmware config is understood, but ignored
+	opcMessage := MakeFadecandyFirmwareConfigMessage(FADECANDY_DISABLE_DITHERING | FADECANDY_LED_ON)
+	want := []byte{0, 1, 0, 2, FADECANDY_DISABLE_DITHERING | FADECANDY_LED_ON}
+	if !bytes.Equal(opcMessage.Bytes, want) {
+		t.Errorf("firmware config message = %v, want %v", opcMessage.Bytes, want)
+	}
+	dispatchSysexMessage(server, opcMessage)
+	if server.fadecandyColorLookup != nil {
+		t.Errorf("firmware config changed the color correction")
+	}
+
+	// a color correction matching our own gamma with a dimmer blue channel
+	dispatchSysexMessage(server, MakeFadecandyColorCorrectionMessage(FadecandyColorCorrection{
+		Gamma:      GAMMA,
+		Whitepoint: [3]float64{1, 1, 0},
+	}))
+	pixels := []byte{0, 128, 255, 255, 64, 255}
+	server.applyFadecandyColorCorrection(pixels)
+	if !bytes.Equal(pixels, []byte{0, 128, 0, 255, 64, 0}) {
+		t.Errorf("color corrected pixels = %v", pixels)
+	}
+
+	// other servers don't see it
+	pixels = []byte{0, 128, 255}
+	(&OpcServerState{}).applyFadecandyColorCorrection(pixels)
+	if !bytes.Equal(pixels, []byte{0, 128, 255}) {
+		t.Errorf("another server's color correction changed the pixels to %v", pixels)
+	}
+}
+
+//================================================================================
+// OPC SOURCE TESTS
+
+// Ask the source thread for a frame, failing if it takes too long.
+func requestFrame(t *testing.T, bytesIn, bytesOut chan []byte, nPixels int) []byte {
+	bytesIn <- make([]byte, nPixels*3)
+	select {
+	case frame := <-bytesOut:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatalf("source thread blocked")
+	}
+	return nil
+}
+
+func TestOpcSourceDoesNotBlock(t *testing.T) {
+	incomingOpcMessageChan := make(chan *OpcMessage, 0)
+	bytesIn := make(chan []byte, 0)
+	bytesOut := make(chan []byte, 0)
+	go makeOpcMessageSourceThread(incomingOpcMessageChan, OpcSourceSettings{})(bytesIn, bytesOut, nil)
+	defer close(bytesIn)
+
+	// black before any input arrives
+	if frame := requestFrame(t, bytesIn, bytesOut, 2); !bytes.Equal(frame, make([]byte, 6)) {
+		t.Errorf("initial frame = %v, want black", frame)
+	}
+
+	// keeps handing out the latest frame without waiting for more input
+	incomingOpcMessageChan <- &OpcMessage{Command: OPC_SET_PIXELS, Bytes: []byte{1, 2, 3, 4, 5, 6}}
+	incomingOpcMessageChan <- &OpcMessage{Command: OPC_SET_PIXELS, Bytes: []byte{7, 8, 9, 10, 11, 12}}
+	// make sure the second message has been composited
+	incomingOpcMessageChan <- &OpcMessage{Command: 99}
+	for ii := 0; ii < 3; ii++ {
+		if frame := requestFrame(t, bytesIn, bytesOut, 2); !bytes.Equal(frame, []byte{7, 8, 9, 10, 11, 12}) {
+			t.Errorf("frame %v = %v, want latest input", ii, frame)
+		}
+	}
+}
+
+func TestInputTimeoutBrightness(t *testing.T) {
+	fade := OpcSourceSettings{InputTimeout: 2, OnTimeout: FADE_TO_BLACK}
+	hold := OpcSourceSettings{InputTimeout: 2, OnTimeout: HOLD_LAST_FRAME}
+	never := OpcSourceSettings{InputTimeout: 0, OnTimeout: FADE_TO_BLACK}
+	cases := []struct {
+		settings          OpcSourceSettings
+		secondsSinceInput float64
+		brightness        float64
+	}{
+		{fade, 1, 1},
+		{fade, 2 + INPUT_FADE_TIME/2, 0.5},
+		{fade, 2 + INPUT_FADE_TIME*2, 0},
+		{hold, 100, 1},
+		{never, 100, 1},
+	}
+	for _, c := range cases {
+		if brightness := inputTimeoutBrightness(c.secondsSinceInput, c.settings); brightness != c.brightness {
+			t.Errorf("inputTimeoutBrightness(%v, %+v) = %v, want %v", c.secondsSinceInput, c.settings, brightness, c.brightness)
+		}
+	}
+}
+
+//================================================================================
+// EFFECTS
+
+func TestEffectRegistry(t *testing.T) {
+	layout := MakeCircleLayout(1, 10, false)
+	for name, effectMaker := range EFFECT_REGISTRY {
+		if effectMaker(layout) == nil {
+			t.Errorf("effect %q made a nil ByteThread", name)
+		}
+	}
+}
+
+func TestEffectGamma(t *testing.T) {
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	go MakeEffectGamma(nil)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+	bytesIn <- []byte{0, 100, 255}
+	if got := <-bytesOut; !bytes.Equal(got, []byte{0, 100, 255}) {
+		t.Errorf("gamma changed the frame to %v; the destinations already correct it", got)
+	}
+}
+
+func TestLimitDuty(t *testing.T) {
+	duty := make([]float64, 256)
+	for ii := range duty {
+		duty[ii] = math.Pow(float64(ii)/255, GAMMA)
+	}
+
+	// dim frames are left alone
+	bytes := []byte{0, 100, 255, 50}
+	limitDuty(bytes, duty, 0.5)
+	if string(bytes) != string([]byte{0, 100, 255, 50}) {
+		t.Errorf("limitDuty changed a dim frame to %v", bytes)
+	}
+
+	// bright frames come down to the limit
+	bytes = []byte{255, 255, 255, 255}
+	limitDuty(bytes, duty, 0.5)
+	total := 0.0
+	for _, b := range bytes {
+		total += duty[b]
+	}
+	if average := total / float64(len(bytes)); average > 0.5 || average < 0.45 {
+		t.Errorf("limitDuty left an average duty of %v, want about 0.5", average)
+	}
+
+	limitDuty([]byte{}, duty, 0.5)
+}
+
+//================================================================================
+// FAN-OUT
+
+func TestFanOutThread(t *testing.T) {
+	received := make(chan []byte, 10)
+	recorder := func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			// report the frame along with the first key's volume
+			frame := make([]byte, len(bytes))
+			copy(frame, bytes)
+			received <- append(frame, midiState.KeyVolumes[0])
+			bytes[0] = 99 // scribbling on our copy shouldn't affect anyone else
+			bytesOut <- bytes
+		}
+	}
+	stuck := make(chan bool)
+	staller := func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			<-stuck
+			bytesOut <- bytes
+		}
+	}
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	midiState := midi.MidiState{}
+	go MakeFanOutThread(staller, recorder, recorder)(bytesIn, bytesOut, &midiState)
+	defer close(bytesIn)
+
+	// the stuck destination only holds up the first frame, until the deadline
+	startTime := time.Now()
+	for ii := 0; ii < 3; ii++ {
+		midiState.KeyVolumes[0] = byte(ii)
+		frame := []byte{byte(ii), 2, 3}
+		bytesIn <- frame
+		if result := <-bytesOut; &result[0] != &frame[0] || result[0] != byte(ii) {
+			t.Errorf("frame %v came back as %v", ii, result)
+		}
+		// the destinations have their own copy of the MidiState, so this can't race with them
+		midiState.KeyVolumes[0] = 50
+		for jj := 0; jj < 2; jj++ {
+			if got := <-received; !bytes.Equal(got, []byte{byte(ii), 2, 3, byte(ii)}) {
+				t.Errorf("destination got %v for frame %v", got, ii)
+			}
+		}
+	}
+	if elapsed := time.Since(startTime); elapsed > 2*FANOUT_TIMEOUT*time.Millisecond {
+		t.Errorf("3 frames took %v; the stuck destination held them up", elapsed)
+	}
+
+	// once it's unstuck it gets frames again
+	stuck <- true
+	time.Sleep(10 * time.Millisecond)
+	bytesIn <- []byte{7, 8, 9}
+	select {
+	case stuck <- true:
+	case <-time.After(time.Second):
+		t.Errorf("the unstuck destination didn't get the next frame")
+	}
+	<-bytesOut
+	<-received
+	<-received
+}
+
+func TestFanOutThreadWaitsForSlowDestination(t *testing.T) {
+	// a healthy destination which takes a while, but less than FANOUT_TIMEOUT
+	received := make(chan byte, 10)
+	slow := func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			time.Sleep(FANOUT_TIMEOUT / 5 * time.Millisecond)
+			received <- bytes[0]
+			bytesOut <- bytes
+		}
+	}
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	go MakeFanOutThread(slow)(bytesIn, bytesOut, nil)
+	defer close(bytesIn)
+
+	for ii := 0; ii < 5; ii++ {
+		bytesIn <- []byte{byte(ii), 0, 0}
+		<-bytesOut
+		// the frame was waited for, so it's already there
+		select {
+		case got := <-received:
+			if got != byte(ii) {
+				t.Errorf("destination got frame %v, want %v", got, ii)
+			}
+		default:
+			t.Errorf("the fan-out didn't wait for frame %v", ii)
+		}
+	}
+}
+
+//================================================================================
+// OUTPUT MAP
+
+func TestParseOutputMap(t *testing.T) {
+	outputMap, err := ParseOutputMap([]byte(`[
+		{"dest": "spi", "first": 0, "count": 6},
+		{"dest": "/dev/spidev2.0", "first": 6, "reverse": true},
+		{"dest": "10.0.0.1:7890", "first": 2, "count": 2, "channel": 3}
+	]`), 10)
+	if err != nil {
+		t.Fatalf("ParseOutputMap failed: %v", err)
+	}
+	want := []OutputMapping{
+		{Dest: "spi", PixelRange: PixelRange{0, 6}},
+		{Dest: "/dev/spidev2.0", PixelRange: PixelRange{6, 4}, Reverse: true},
+		{Dest: "10.0.0.1:7890", PixelRange: PixelRange{2, 2}, Channel: 3},
+	}
+	if len(outputMap) != len(want) {
+		t.Fatalf("got %v outputs, want %v", len(outputMap), len(want))
+	}
+	for ii := range want {
+		if outputMap[ii] != want[ii] {
+			t.Errorf("output %v = %+v, want %+v", ii, outputMap[ii], want[ii])
+		}
+	}
+
+	bad := []string{
+		`[]`,
+		`{"dest": "spi"}`,
+		`[{"first": 0, "count": 1}]`,
+		`[{"dest": "spi", "first": 8, "count": 3}]`,
+		`[{"dest": "spi", "first": -1, "count": 3}]`,
+		`[{"dest": "spi", "first": 10}]`,
+		`[{"dest": "spi", "channel": 256}]`,
+	}
+	for _, data := range bad {
+		if _, err := ParseOutputMap([]byte(data), 10); err == nil {
+			t.Errorf("ParseOutputMap(%s) should have failed", data)
+		}
+	}
+}
+
+func TestExtractPixels(t *testing.T) {
+	frame := []byte{0, 0, 0, 1, 1, 1, 2, 2, 2, 3, 3, 3}
+	bytes := make([]byte, 6)
+	extractPixels(bytes, frame, PixelRange{1, 2}, false)
+	if string(bytes) != string([]byte{1, 1, 1, 2, 2, 2}) {
+		t.Errorf("extractPixels = %v", bytes)
+	}
+	extractPixels(bytes, frame, PixelRange{2, 2}, true)
+	if string(bytes) != string([]byte{3, 3, 3, 2, 2, 2}) {
+		t.Errorf("reversed extractPixels = %v", bytes)
+	}
+	extractPixels(bytes, frame, PixelRange{3, 2}, false)
+	if string(bytes) != string([]byte{3, 3, 3, 0, 0, 0}) {
+		t.Errorf("extractPixels past the end of the frame = %v", bytes)
+	}
+}
+
+func TestOutputThread(t *testing.T) {
+	received := make(chan []byte, 1)
+	recorder := func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			received <- append([]byte{}, bytes...)
+			bytes[0] = 99
+			bytesOut <- bytes
+		}
+	}
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	output := OutputMapping{Dest: "test", PixelRange: PixelRange{1, 2}, Reverse: true}
+	go MakeOutputThread(output, recorder)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+
+	frame := []byte{0, 0, 0, 1, 1, 1, 2, 2, 2, 3, 3, 3}
+	bytesIn <- frame
+	<-bytesOut
+	if got := <-received; string(got) != string([]byte{2, 2, 2, 1, 1, 1}) {
+		t.Errorf("destination got %v", got)
+	}
+	if frame[0] != 0 || frame[3] != 1 || frame[6] != 2 {
+		t.Errorf("destination changed the frame to %v", frame)
+	}
+}
+
+//================================================================================
+// SPI OUTPUT
+
+// Make a frame of nPixels which covers a wide range of brightnesses and colors.
+func makeTestFrame(nPixels int) []byte {
+	frame := make([]byte, nPixels*3)
+	for ii := range frame {
+		frame[ii] = byte(ii * ii * 37 % 256)
+	}
+	// some special cases at the start
+	copy(frame, []byte{
+		0, 0, 0,
+		255, 255, 255,
+		128, 0, 0,
+		1, 2, 3,
+	})
+	return frame
+}
+
+// Run a frame through an SPI ByteThread which writes to a regular file and check that the
+// file matches the golden file in testdata.
+func checkSpiGolden(t *testing.T, makeThread func(spiFn string) ByteThread, frame []byte, goldenFn string) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spiFn := filepath.Join(dir, "spidev")
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	done := make(chan bool)
+	go func() {
+		makeThread(spiFn)(bytesIn, bytesOut, &midi.MidiState{})
+		done <- true
+	}()
+	bytesIn <- frame
+	<-bytesOut
+	close(bytesIn)
+	<-done // the file is closed once the thread returns
+
+	got, err := ioutil.ReadFile(spiFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *updateGolden {
+		if err := ioutil.WriteFile(goldenFn, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(goldenFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("SPI output doesn't match %s:\ngot  %x\nwant %x", goldenFn, got, want)
+	}
+}
+
+// Make an SPI ByteThread maker for checkSpiGolden.
+func spiThreadMaker(chipset SpiChipset) func(spiFn string) ByteThread {
+	return func(spiFn string) ByteThread {
+		return MakeSendToSpiThread(spiFn, chipset, nil)
+	}
+}
+
+func TestSpiGolden(t *testing.T) {
+	frame := makeTestFrame(70)
+	checkSpiGolden(t, spiThreadMaker(LPD8806Chipset{}), frame, "testdata/lpd8806.golden")
+	checkSpiGolden(t, spiThreadMaker(APA102Chipset{}), frame, "testdata/apa102.golden")
+	checkSpiGolden(t, spiThreadMaker(WS2801Chipset{}), frame, "testdata/ws2801.golden")
+	checkSpiGolden(t, spiThreadMaker(WS2812Chipset{SpiHz: WS2812_DEFAULT_SPI_HZ}), frame, "testdata/ws2812.golden")
+}
+
+func TestParseColorOrder(t *testing.T) {
+	if order, err := parseColorOrder("grb"); err != nil || order != [3]int{1, 0, 2} {
+		t.Errorf("parseColorOrder(grb) = %v, %v", order, err)
+	}
+	for _, colorOrder := range []string{"", "RG", "RGBW", "RRB", "RGX"} {
+		if _, err := parseColorOrder(colorOrder); err == nil {
+			t.Errorf("parseColorOrder(%q) should have failed", colorOrder)
+		}
+	}
+}
+
+func TestSpiEncoderPixelFormats(t *testing.T) {
+	pixelFormats := []PixelFormat{
+		DEFAULT_PIXEL_FORMAT,
+		{ColorOrder: "BRG", WhiteBalance: [3]float64{1, 0.5, 0}},
+	}
+	encoder, err := newSpiEncoder(WS2801Chipset{}, pixelFormats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the third pixel is past the end of pixelFormats
+	spiBytes := encoder.encode(nil, []byte{255, 0, 0, 255, 255, 255, 0, 0, 255})
+	want := []byte{255, 0, 0, 0, 255, 128, 0, 0, 255}
+	if !bytes.Equal(spiBytes, want) {
+		t.Errorf("encode = %v, want %v", spiBytes, want)
+	}
+
+	if _, err := newSpiEncoder(WS2801Chipset{}, []PixelFormat{{ColorOrder: "XYZ"}}); err == nil {
+		t.Errorf("newSpiEncoder should reject a bad color order")
+	}
+}
+
+func TestAPA102Pixels(t *testing.T) {
+	encoder, err := newSpiEncoder(APA102Chipset{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiBytes := encoder.encode(nil, []byte{0, 0, 0, 255, 255, 255, 128, 0, 0})
+	want := []byte{
+		0, 0, 0, 0, // start frame
+		0xE1, 0, 0, 0, // black
+		0xFF, 255, 255, 255, // full white
+		0xE7, 0, 0, 248, // dim red gets a low global brightness and a high color value
+		0xFF, 0xFF, 0xFF, 0xFF, // end frame
+	}
+	if !bytes.Equal(spiBytes, want) {
+		t.Errorf("APA102 frame = %x, want %x", spiBytes, want)
+	}
+
+	// long strips need longer end frames
+	spiBytes = encoder.encode(nil, make([]byte, 100*3))
+	if len(spiBytes) != 4+100*4+7 {
+		t.Errorf("APA102 frame of 100 pixels is %v bytes long, want %v", len(spiBytes), 4+100*4+7)
+	}
+}
+
+func TestWS2812Pixels(t *testing.T) {
+	// at 2.4 MHz a 0 is 100 and a 1 is 110
+	spiBytes := WS2812Chipset{SpiHz: 2400000}.AppendPixel(nil, [3]float64{0, 1, 0})
+	want := []byte{
+		0x92, 0x49, 0x24, // 00000000
+		0xDB, 0x6D, 0xB6, // 11111111
+		0x92, 0x49, 0x24, // 00000000
+	}
+	if !bytes.Equal(spiBytes, want) {
+		t.Errorf("WS2812 pixel = %x, want %x", spiBytes, want)
+	}
+
+	// at other clock rates the pulses get longer, but a pixel is still a whole number of bytes
+	for _, spiHz := range []int{3200000, 4000000, 6400000} {
+		chipset := WS2812Chipset{SpiHz: spiHz}
+		bitLen, zeroLen, oneLen := chipset.bitTiming()
+		if !(0 < zeroLen && zeroLen < oneLen && oneLen < bitLen) {
+			t.Errorf("bad WS2812 bit timing at %v Hz: %v %v %v", spiHz, bitLen, zeroLen, oneLen)
+		}
+		if n := len(chipset.AppendPixel(nil, [3]float64{})); n != bitLen*3 {
+			t.Errorf("WS2812 pixel at %v Hz is %v bytes, want %v", spiHz, n, bitLen*3)
+		}
+	}
+
+	// the reset at the end is at least WS2812_RESET_TIME long
+	if n := len(WS2812Chipset{SpiHz: 2400000}.AppendEndFrame(nil, 10)); n != 90 {
+		t.Errorf("WS2812 end frame is %v bytes, want 90", n)
+	}
+}
+
+func TestSendToOpcPixelFormats(t *testing.T) {
+	listener, incomingOpcMessageChan := startTestOpcServer(t)
+	defer listener.Close()
+
+	pixelFormats := []PixelFormat{
+		DEFAULT_PIXEL_FORMAT,
+		{ColorOrder: "BRG", WhiteBalance: [3]float64{1, 1, 0.5}},
+	}
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	go MakeSendToOpcChannelThread(listener.Addr().String(), 3, pixelFormats)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+
+	bytesIn <- []byte{255, 0, 0, 0, 255, 255}
+	<-bytesOut
+	select {
+	case opcMessage := <-incomingOpcMessageChan:
+		// the second pixel's blue is halved and comes first
+		want := []byte{255, 0, 0, 128, 0, 255}
+		if opcMessage.Channel != 3 || !bytes.Equal(opcMessage.Bytes, want) {
+			t.Errorf("got channel %v %v, want channel 3 %v", opcMessage.Channel, opcMessage.Bytes, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no message arrived")
+	}
+}
+
+//================================================================================
+// ART-NET
+
+func TestParseArtnetUrl(t *testing.T) {
+	cases := map[string]ArtnetSettings{
+		"artnet://10.0.0.5":                          {Addresses: []string{"10.0.0.5:6454"}},
+		"artnet://10.0.0.5:7000?universe=3":          {Addresses: []string{"10.0.0.5:7000"}, Universe: 3},
+		"artnet://node.local?universe=1&sync=true":   {Addresses: []string{"node.local:6454"}, Universe: 1, Sync: true},
+		"artnet://255.255.255.255?sync=1&universe=0": {Addresses: []string{"255.255.255.255:6454"}, Sync: true},
+		"artnet://10.0.0.5?node=10.0.0.6&node=b.local:7000": {
+			Addresses: []string{"10.0.0.5:6454", "10.0.0.6:6454", "b.local:7000"},
+		},
+	}
+	for rawurl, want := range cases {
+		if settings, err := ParseArtnetUrl(rawurl); err != nil || !reflect.DeepEqual(settings, want) {
+			t.Errorf("ParseArtnetUrl(%q) = %+v, %v; want %+v", rawurl, settings, err, want)
+		}
+	}
+	for _, rawurl := range []string{
+		"artnet://",
+		"sacn://10.0.0.5",
+		"artnet://10.0.0.5?universe=-1",
+		"artnet://10.0.0.5?universe=40000",
+		"artnet://10.0.0.5?sync=maybe",
+		"artnet://10.0.0.5?univrese=1",
+		"artnet://10.0.0.5?node=",
+		"artnet://10.0.0.5?node=:7000",
+	} {
+		if _, err := ParseArtnetUrl(rawurl); err == nil {
+			t.Errorf("ParseArtnetUrl(%q) should have failed", rawurl)
+		}
+	}
+}
+
+func TestCheckUniverseRange(t *testing.T) {
+	// 171 pixels take two universes
+	if err := checkUniverseRange(ARTNET_MAX_PORT_ADDRESS-1, 171, ARTNET_MAX_PORT_ADDRESS); err != nil {
+		t.Errorf("checkUniverseRange rejected universes which fit: %v", err)
+	}
+	if err := checkUniverseRange(ARTNET_MAX_PORT_ADDRESS, 171, ARTNET_MAX_PORT_ADDRESS); err == nil {
+		t.Errorf("checkUniverseRange should reject universes past the last one")
+	}
+	if err := checkUniverseRange(SACN_MAX_UNIVERSE, 0, SACN_MAX_UNIVERSE); err != nil {
+		t.Errorf("checkUniverseRange rejected an empty frame: %v", err)
+	}
+}
+
+// Listen for UDP packets on a loopback port.
+// Return the connection (so the test can close it) and a channel of the packets.
+func startTestUdpListener(t *testing.T) (net.PacketConn, chan []byte) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on loopback: %v", err)
+	}
+	packets := make(chan []byte, 100)
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, _, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			packets <- append([]byte{}, buffer[:n]...)
+		}
+	}()
+	return packetConn, packets
+}
+
+func receiveTestPacket(t *testing.T, packets chan []byte) []byte {
+	select {
+	case packet := <-packets:
+		return packet
+	case <-time.After(time.Second):
+		t.Fatalf("no packet arrived")
+	}
+	return nil
+}
+
+func TestSendToArtnet(t *testing.T) {
+	packetConn, packets := startTestUdpListener(t)
+	defer packetConn.Close()
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	settings := ArtnetSettings{Addresses: []string{packetConn.LocalAddr().String()}, Universe: 0x1ff, Sync: true}
+	go MakeSendToArtnetThread(settings, nil)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+
+	// 171 pixels fill one universe and spill one pixel into the next
+	frame := make([]byte, 171*3)
+	frame[0] = 255
+	frame[170*3+2] = 255
+	for sequence := byte(1); sequence <= 2; sequence++ {
+		bytesIn <- frame
+		<-bytesOut
+
+		first := receiveTestPacket(t, packets)
+		header := append([]byte("Art-Net\x00"), 0x00, 0x50, 0, 14, sequence, 0, 0xff, 0x01, 0x01, 0xfe)
+		if !bytes.Equal(first[:18], header) || len(first) != 18+510 || first[18] != 255 {
+			t.Errorf("first ArtDMX packet = %x", first[:20])
+		}
+		// the length of the second universe is padded to be even
+		second := receiveTestPacket(t, packets)
+		header = append([]byte("Art-Net\x00"), 0x00, 0x50, 0, 14, sequence, 0, 0x00, 0x02, 0, 4)
+		if !bytes.Equal(second, append(header, 0, 0, 255, 0)) {
+			t.Errorf("second ArtDMX packet = %x", second)
+		}
+		sync := receiveTestPacket(t, packets)
+		if !bytes.Equal(sync, append([]byte("Art-Net\x00"), 0x00, 0x52, 0, 14, 0, 0)) {
+			t.Errorf("ArtSync packet = %x", sync)
+		}
+	}
+}
+
+func TestSendToArtnetNodes(t *testing.T) {
+	nodes := make([]chan []byte, 2)
+	settings := ArtnetSettings{Sync: true}
+	for ii := range nodes {
+		packetConn, packets := startTestUdpListener(t)
+		defer packetConn.Close()
+		nodes[ii] = packets
+		settings.Addresses = append(settings.Addresses, packetConn.LocalAddr().String())
+	}
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	go MakeSendToArtnetThread(settings, nil)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+	bytesIn <- []byte{255, 0, 255}
+	<-bytesOut
+
+	// every node gets the ArtDMX and the ArtSync
+	for ii, packets := range nodes {
+		if dmx := receiveTestPacket(t, packets); !bytes.Equal(dmx, makeArtDmxPacket(1, 0, []byte{255, 0, 255})) {
+			t.Errorf("node %v got ArtDMX packet %x", ii, dmx)
+		}
+		if sync := receiveTestPacket(t, packets); !bytes.Equal(sync, makeArtSyncPacket()) {
+			t.Errorf("node %v got ArtSync packet %x", ii, sync)
+		}
+	}
+}
+
+//================================================================================
+// SACN
+
+func TestParseSacnUrl(t *testing.T) {
+	cid := [16]byte{0x5c, 0x2a, 0x3a, 0x47, 0x0a, 0x3b, 0x4a, 0x5e, 0x9d, 0x43, 0x6c, 0x1f, 0x6c, 0x0d, 0xe0, 0xa1}
+	cases := map[string]SacnSettings{
+		"sacn://?cid=5c2a3a47-0a3b-4a5e-9d43-6c1f6c0de0a1": {
+			Universe: 1, Priority: 100, SourceName: "pixelslinger", Cid: cid,
+		},
+		"sacn://10.0.0.5?universe=3&priority=150&name=tower&sync=7000&cid=5C2A3A470A3B4A5E9D436C1F6C0DE0A1": {
+			Address: "10.0.0.5:5568", Universe: 3, Priority: 150, SourceName: "tower", Cid: cid, SyncUniverse: 7000,
+		},
+		"sacn://node.local:6000?cid=5c2a3a47-0a3b-4a5e-9d43-6c1f6c0de0a1": {
+			Address: "node.local:6000", Universe: 1, Priority: 100, SourceName: "pixelslinger", Cid: cid,
+		},
+	}
+	for rawurl, want := range cases {
+		if settings, err := ParseSacnUrl(rawurl); err != nil || settings != want {
+			t.Errorf("ParseSacnUrl(%q) = %+v, %v; want %+v", rawurl, settings, err, want)
+		}
+	}
+	for _, rawurl := range []string{
+		"artnet://10.0.0.5",
+		"sacn://:6000",
+		"sacn://10.0.0.5?universe=0",
+		"sacn://10.0.0.5?universe=64000",
+		"sacn://10.0.0.5?priority=201",
+		"sacn://10.0.0.5?sync=-1",
+		"sacn://10.0.0.5?cid=1234",
+		"sacn://10.0.0.5?name=" + strings.Repeat("x", 64),
+		"sacn://10.0.0.5?univrese=1",
+	} {
+		if _, err := ParseSacnUrl(rawurl); err == nil {
+			t.Errorf("ParseSacnUrl(%q) should have failed", rawurl)
+		}
+	}
+
+	// the default CID stays the same from run to run, but depends on the name
+	first, _ := ParseSacnUrl("sacn://")
+	second, _ := ParseSacnUrl("sacn://")
+	other, _ := ParseSacnUrl("sacn://?name=other")
+	if first.Cid != second.Cid || first.Cid == other.Cid || first.Cid[6]>>4 != 5 {
+		t.Errorf("default CIDs %x, %x, %x", first.Cid, second.Cid, other.Cid)
+	}
+}
+
+func TestSacnMulticastAddress(t *testing.T) {
+	for universe, want := range map[int]string{
+		1:     "239.255.0.1:5568",
+		300:   "239.255.1.44:5568",
+		63999: "239.255.249.255:5568",
+	} {
+		if address := sacnMulticastAddress(universe); address != want {
+			t.Errorf("sacnMulticastAddress(%v) = %v, want %v", universe, address, want)
+		}
+	}
+}
+
+func TestSendToSacn(t *testing.T) {
+	packetConn, packets := startTestUdpListener(t)
+	defer packetConn.Close()
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	settings := SacnSettings{
+		Address:      packetConn.LocalAddr().String(),
+		Universe:     0x1ff,
+		Priority:     150,
+		SourceName:   "tower",
+		Cid:          [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SyncUniverse: 7000,
+	}
+	go MakeSendToSacnThread(settings, nil)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+
+	// the root layer, up to the framing layer's vector
+	rootLayer := func(length int, vector byte) []byte {
+		header := []byte{0x00, 0x10, 0x00, 0x00}
+		header = append(header, "ASC-E1.17\x00\x00\x00"...)
+		header = append(header, 0x70|byte((length-16)>>8), byte(length-16), 0, 0, 0, vector)
+		header = append(header, settings.Cid[:]...)
+		return append(header, 0x70|byte((length-38)>>8), byte(length-38))
+	}
+
+	// 171 pixels fill one universe and spill one pixel into the next
+	frame := make([]byte, 171*3)
+	frame[0] = 255
+	frame[170*3+2] = 255
+	for sequence := byte(1); sequence <= 2; sequence++ {
+		bytesIn <- frame
+		<-bytesOut
+
+		for uu, data := range [][]byte{frame[:510], frame[510:]} {
+			packet := receiveTestPacket(t, packets)
+			want := append(rootLayer(126+len(data), 4), 0, 0, 0, 2)
+			want = append(want, "tower"...)
+			want = append(want, make([]byte, 64-len("tower"))...)
+			universe := settings.Universe + uu
+			want = append(want, 150, 0x1b, 0x58, sequence, 0, byte(universe>>8), byte(universe))
+			want = append(want, 0x70|byte((len(data)+11)>>8), byte(len(data)+11), 0x02, 0xa1, 0, 0, 0, 1)
+			want = append(want, byte((len(data)+1)>>8), byte(len(data)+1), 0)
+			want = append(want, data...)
+			if !bytes.Equal(packet, want) {
+				t.Errorf("data packet for universe %v:\n got %x\nwant %x", uu, packet, want)
+			}
+		}
+		sync := receiveTestPacket(t, packets)
+		want := append(rootLayer(49, 8), 0, 0, 0, 1, sequence, 0x1b, 0x58, 0, 0)
+		if !bytes.Equal(sync, want) {
+			t.Errorf("sync packet:\n got %x\nwant %x", sync, want)
+		}
+	}
+}
+
+//================================================================================
+// DDP
+
+func TestParseDDPUrl(t *testing.T) {
+	for rawurl, want := range map[string]string{
+		"ddp://10.0.0.5":      "10.0.0.5:4048",
+		"ddp://wled.local:99": "wled.local:99",
+	} {
+		if ipPort, err := ParseDDPUrl(rawurl); err != nil || ipPort != want {
+			t.Errorf("ParseDDPUrl(%q) = %v, %v; want %v", rawurl, ipPort, err, want)
+		}
+	}
+	for _, rawurl := range []string{"ddp://", "sacn://10.0.0.5", "ddp://10.0.0.5?push=false"} {
+		if _, err := ParseDDPUrl(rawurl); err == nil {
+			t.Errorf("ParseDDPUrl(%q) should have failed", rawurl)
+		}
+	}
+}
+
+func TestSendToDDP(t *testing.T) {
+	packetConn, packets := startTestUdpListener(t)
+	defer packetConn.Close()
+
+	bytesIn := make(chan []byte)
+	bytesOut := make(chan []byte)
+	go MakeSendToDDPThread(packetConn.LocalAddr().String(), nil)(bytesIn, bytesOut, &midi.MidiState{})
+	defer close(bytesIn)
+
+	// 1000 pixels take three packets, and the sequence numbers wrap around after 15
+	frame := make([]byte, 1000*3)
+	for ii := range frame {
+		frame[ii] = byte(ii%2) * 255
+	}
+	sequence := byte(0)
+	for ff := 0; ff < 6; ff++ {
+		bytesIn <- frame
+		<-bytesOut
+
+		for offset := 0; offset < len(frame); offset += 1440 {
+			endIndex := offset + 1440
+			flags := byte(0x40)
+			if endIndex >= len(frame) {
+				endIndex = len(frame)
+				flags |= 0x01
+			}
+			sequence = sequence%15 + 1
+			length := endIndex - offset
+			want := []byte{flags, sequence, 0x0b, 1, 0, 0, byte(offset >> 8), byte(offset), byte(length >> 8), byte(length)}
+			want = append(want, frame[offset:endIndex]...)
+			if packet := receiveTestPacket(t, packets); !bytes.Equal(packet, want) {
+				t.Errorf("frame %v offset %v: got header %x, want %x", ff, offset, packet[:10], want[:10])
+			}
+		}
+	}
+}
+
+//================================================================================
+// DMX INPUT
+
+func TestParseDmxSourceUrl(t *testing.T) {
+	cases := map[string]DmxSourceSettings{
+		"artnet://":                              {Scheme: "artnet", Address: ":6454"},
+		"artnet://10.0.0.2:7000?universe=3":      {Scheme: "artnet", Address: "10.0.0.2:7000", Universe: 3},
+		"sacn://":                                {Scheme: "sacn", Address: ":5568", Universe: 1},
+		"sacn://?universe=7&multicast=true":      {Scheme: "sacn", Address: ":5568", Universe: 7, Multicast: true},
+		"sacn://10.0.0.2?multicast=0&universe=2": {Scheme: "sacn", Address: "10.0.0.2:5568", Universe: 2},
+		"sacn://10.0.0.2?multicast=true":         {Scheme: "sacn", Address: "10.0.0.2:5568", Universe: 1, Multicast: true},
+	}
+	for rawurl, want := range cases {
+		if settings, err := ParseDmxSourceUrl(rawurl); err != nil || settings != want {
+			t.Errorf("ParseDmxSourceUrl(%q) = %+v, %v; want %+v", rawurl, settings, err, want)
+		}
+	}
+	for _, rawurl := range []string{
+		"ddp://",
+		"sacn://?universe=0",
+		"artnet://?universe=40000",
+		"artnet://?multicast=true",
+		"sacn://?priority=100",
+		"sacn://lights.local?multicast=true",
+	} {
+		if _, err := ParseDmxSourceUrl(rawurl); err == nil {
+			t.Errorf("ParseDmxSourceUrl(%q) should have failed", rawurl)
+		}
+	}
+}
+
+func TestReadUniverseMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "test.universes.json")
+
+	ioutil.WriteFile(fn, []byte(`[{"universe": 1, "first": 0, "count": 170}, {"universe": 5, "first": 170, "count": 30}]`), 0644)
+	universeMap, err := ReadUniverseMap(fn, SACN_SCHEME, 200)
+	if err != nil {
+		t.Fatalf("ReadUniverseMap failed: %v", err)
+	}
+	if len(universeMap) != 2 || universeMap[1] != (PixelRange{0, 170}) || universeMap[5] != (PixelRange{170, 30}) {
+		t.Errorf("ReadUniverseMap = %v", universeMap)
+	}
+
+	// range past the end of the layout
+	if _, err := ReadUniverseMap(fn, SACN_SCHEME, 199); err == nil {
+		t.Errorf("ReadUniverseMap should reject ranges outside the layout")
+	}
+
+	// more pixels than fit in a universe
+	ioutil.WriteFile(fn, []byte(`[{"universe": 1, "first": 0, "count": 171}]`), 0644)
+	if _, err := ReadUniverseMap(fn, SACN_SCHEME, 200); err == nil {
+		t.Errorf("ReadUniverseMap should reject universes with more than 170 pixels")
+	}
+
+	// universes each protocol does and doesn't allow
+	for _, c := range []struct {
+		scheme   string
+		universe int
+		ok       bool
+	}{
+		{SACN_SCHEME, 0, false},
+		{SACN_SCHEME, 63999, true},
+		{SACN_SCHEME, 64000, false},
+		{ARTNET_SCHEME, 0, true},
+		{ARTNET_SCHEME, 32767, true},
+		{ARTNET_SCHEME, 32768, false},
+		{ARTNET_SCHEME, -1, false},
+	} {
+		ioutil.WriteFile(fn, []byte(fmt.Sprintf(`[{"universe": %v, "first": 0, "count": 10}]`, c.universe)), 0644)
+		if _, err := ReadUniverseMap(fn, c.scheme, 200); (err == nil) != c.ok {
+			t.Errorf("ReadUniverseMap with %s universe %v: err = %v", c.scheme, c.universe, err)
+		}
+	}
+}
+
+func TestDefaultUniverseMap(t *testing.T) {
+	universeMap := DefaultUniverseMap(3, 400)
+	want := UniverseMap{3: {0, 170}, 4: {170, 170}, 5: {340, 60}}
+	if len(universeMap) != len(want) {
+		t.Fatalf("DefaultUniverseMap(3, 400) = %v, want %v", universeMap, want)
+	}
+	for universe, pixelRange := range want {
+		if universeMap[universe] != pixelRange {
+			t.Errorf("DefaultUniverseMap(3, 400) = %v, want %v", universeMap, want)
+		}
+	}
+}
+
+func TestParseDmxPackets(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5}
+	if universe, parsed, ok := parseArtDmxPacket(makeArtDmxPacket(7, 0x123, data)); !ok || universe != 0x123 || !bytes.Equal(parsed, append(data, 0)) {
+		t.Errorf("parseArtDmxPacket = %v, %v, %v", universe, parsed, ok)
+	}
+	if _, _, ok := parseArtDmxPacket(makeArtSyncPacket()); ok {
+		t.Errorf("parseArtDmxPacket should ignore ArtSync packets")
+	}
+
+	sacnSettings := SacnSettings{Priority: 100, SourceName: "console"}
+	packet := makeSacnDataPacket(sacnSettings, 7, 300, data)
+	if universe, parsed, ok := parseSacnDataPacket(packet); !ok || universe != 300 || !bytes.Equal(parsed, data) {
+		t.Errorf("parseSacnDataPacket = %v, %v, %v", universe, parsed, ok)
+	}
+	packet[112] = 0x80 // preview data
+	if _, _, ok := parseSacnDataPacket(packet); ok {
+		t.Errorf("parseSacnDataPacket should ignore preview data")
+	}
+	if _, _, ok := parseSacnDataPacket(makeSacnSyncPacket(sacnSettings, 1)); ok {
+		t.Errorf("parseSacnDataPacket should ignore sync packets")
+	}
+	if _, _, ok := parseSacnDataPacket(makeArtDmxPacket(7, 1, data)); ok {
+		t.Errorf("parseSacnDataPacket should ignore Art-Net")
+	}
+}
+
+func TestCompositeDmxMessage(t *testing.T) {
+	universeMap := UniverseMap{1: {0, 2}, 2: {2, 1}}
+	frame := make([]byte, 3*3)
+
+	// universes only touch their own ranges, and extra or partial pixels are dropped
+	compositeDmxMessage(frame, &DmxMessage{Universe: 2, Data: []byte{1, 1, 1, 2, 2, 2}}, universeMap)
+	compositeDmxMessage(frame, &DmxMessage{Universe: 1, Data: []byte{3, 3, 3, 4}}, universeMap)
+	if ok := compositeDmxMessage(frame, &DmxMessage{Universe: 3, Data: []byte{5, 5, 5}}, universeMap); ok {
+		t.Errorf("compositeDmxMessage should ignore universes which aren't in the map")
+	}
+	want := []byte{3, 3, 3, 0, 0, 0, 1, 1, 1}
+	if !bytes.Equal(frame, want) {
+		t.Errorf("composited frame = %v, want %v", frame, want)
+	}
+}
+
+// Find a UDP port on the loopback interface which nobody is using right now.
+func freeUdpAddress(t *testing.T) string {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on loopback: %v", err)
+	}
+	defer packetConn.Close()
+	return packetConn.LocalAddr().String()
+}
+
+// Send a frame with our own Art-Net or sACN output and check that the DMX source puts it back together.
+func checkDmxRoundTrip(t *testing.T, dmxSettings DmxSourceSettings, destThread ByteThread) {
+	nPixels := 200
+	sourceIn := make(chan []byte, 0)
+	sourceOut := make(chan []byte, 0)
+	go MakeDmxServerThread(dmxSettings, nil, OpcSourceSettings{})(sourceIn, sourceOut, nil)
+	defer close(sourceIn)
+	destIn := make(chan []byte, 0)
+	destOut := make(chan []byte, 0)
+	go destThread(destIn, destOut, &midi.MidiState{})
+	defer close(destIn)
+
+	frame := make([]byte, nPixels*3)
+	for ii := range frame {
+		frame[ii] = byte(ii%3/2) * 255
+	}
+	// the first request starts the server
+	requestFrame(t, sourceIn, sourceOut, nPixels)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		destIn <- frame
+		<-destOut
+		if bytes.Equal(requestFrame(t, sourceIn, sourceOut, nPixels), frame) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%s source never received the frame", dmxSettings.Scheme)
+}
+
+func TestArtnetSource(t *testing.T) {
+	address := freeUdpAddress(t)
+	dmxSettings := DmxSourceSettings{Scheme: ARTNET_SCHEME, Address: address, Universe: 4}
+	checkDmxRoundTrip(t, dmxSettings, MakeSendToArtnetThread(ArtnetSettings{Addresses: []string{address}, Universe: 4}, nil))
+}
+
+func TestSacnSource(t *testing.T) {
+	address := freeUdpAddress(t)
+	dmxSettings := DmxSourceSettings{Scheme: SACN_SCHEME, Address: address, Universe: 4}
+	checkDmxRoundTrip(t, dmxSettings, MakeSendToSacnThread(SacnSettings{Address: address, Universe: 4, Priority: 100}, nil))
+}
+
+func TestSacnMulticastSource(t *testing.T) {
+	// use a port of our own instead of SACN_PORT, so we can't hear anybody else's show
+	_, port, _ := net.SplitHostPort(freeUdpAddress(t))
+	dmxSettings := DmxSourceSettings{Scheme: SACN_SCHEME, Address: ":" + port, Universe: 4, Multicast: true}
+	groupAddrs := make([]*net.UDPAddr, 2)
+	for uu := range groupAddrs {
+		group, _, _ := net.SplitHostPort(sacnMulticastAddress(4 + uu))
+		groupAddrs[uu], _ = net.ResolveUDPAddr("udp", net.JoinHostPort(group, port))
+	}
+	// skip where there's no multicast, rather than letting the server panic
+	probe, err := net.ListenMulticastUDP("udp", nil, groupAddrs[0])
+	if err != nil {
+		t.Skipf("can't listen to multicast here: %v", err)
+	}
+	probe.Close()
+	packetConn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	if _, err := packetConn.WriteTo([]byte{0}, groupAddrs[0]); err != nil {
+		t.Skipf("can't send multicast here: %v", err)
+	}
+
+	// send each universe to its group, like MakeSendToSacnThread does on SACN_PORT
+	destThread := func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		for bytes := range bytesIn {
+			for uu, data := range splitUniverses(bytes) {
+				packetConn.WriteTo(makeSacnDataPacket(SacnSettings{Priority: 100}, 0, 4+uu, data), groupAddrs[uu])
+			}
+			bytesOut <- bytes
+		}
+	}
+	checkDmxRoundTrip(t, dmxSettings, destThread)
+}
+
+func TestListenSacnMulticastUnknownInterface(t *testing.T) {
+	// a documentation address, which no interface should have
+	if conn, err := listenSacnMulticast("192.0.2.1", "0", []int{1}); err == nil {
+		conn.Close()
+		t.Errorf("listening on an interface which doesn't exist should have failed")
+	}
+}
+
+//================================================================================
+// RECORDING
+
+// Read all the frames of a recording.
+func readTestRecording(t *testing.T, fn string) (RecordingHeader, [][]byte, []time.Time) {
+	recording, err := OpenRecording(fn)
+	if err != nil {
+		t.Fatalf("OpenRecording failed: %v", err)
+	}
+	defer recording.Close()
+	frames := make([][]byte, 0)
+	times := make([]time.Time, 0)
+	for {
+		frame := make([]byte, recording.Header.NPixels*3)
+		frameTime, err := recording.ReadFrame(frame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame failed: %v", err)
+		}
+		frames = append(frames, frame)
+		times = append(times, frameTime)
+	}
+	return recording.Header, frames, times
+}
+
+func TestSendToRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layout, _ := ParseLayout([]byte(`[{"point": [0, 0, 0]}, {"point": [1, 0, 0]}]`))
+	defer SetFrameContext(CurrentFrame())
+
+	for _, fn := range []string{"show.rec", "show.rec.gz"} {
+		fn = filepath.Join(dir, fn)
+		bytesIn := make(chan []byte)
+		bytesOut := make(chan []byte)
+		go MakeSendToRecordingThread(fn, layout)(bytesIn, bytesOut, &midi.MidiState{})
+		// the frames are stamped from the frame clock, not the wall clock
+		clock := MakeFixedStepClock(1000, 4)
+		want := [][]byte{{1, 2, 3, 4, 5, 6}, {7, 8, 9, 10, 11, 12}, {255, 0, 0, 0, 0, 255}}
+		for _, frame := range want {
+			SetFrameContext(clock.Tick())
+			bytesIn <- frame
+			if sent := <-bytesOut; !bytes.Equal(sent, frame) {
+				t.Errorf("%s: recording changed the frame to %v", fn, sent)
+			}
+		}
+
+		// every frame has been flushed, even before the recording is closed
+		header, frames, times := readTestRecording(t, fn)
+		startTime := time.Unix(int64(PATTERN_TIME_OFFSET)+1000, 0)
+		if header.NPixels != 2 || header.LayoutHash != layout.Hash() || !header.StartTime.Equal(startTime) {
+			t.Errorf("%s: header = %+v", fn, header)
+		}
+		if len(frames) != len(want) {
+			t.Fatalf("%s: read %v frames, want %v", fn, len(frames), len(want))
+		}
+		for ii := range want {
+			if !bytes.Equal(frames[ii], want[ii]) {
+				t.Errorf("%s: frame %v = %v, want %v", fn, ii, frames[ii], want[ii])
+			}
+			if wantTime := startTime.Add(time.Duration(ii) * 250 * time.Millisecond); !times[ii].Equal(wantTime) {
+				t.Errorf("%s: frame %v was stamped %v, want %v", fn, ii, times[ii], wantTime)
+			}
+		}
+		close(bytesIn)
+	}
+}
+
+func TestTruncatedRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "show.rec")
+
+	recording, err := CreateRecording(fn, RecordingHeader{NPixels: 2, StartTime: time.Unix(100, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording.WriteFrame(time.Unix(100, 5), []byte{1, 2, 3, 4, 5, 6})
+	recording.WriteFrame(time.Unix(101, 0), []byte{6, 5, 4, 3, 2, 1})
+	if err := recording.WriteFrame(time.Unix(102, 0), []byte{1, 2, 3}); err == nil {
+		t.Errorf("WriteFrame should reject frames with the wrong number of pixels")
+	}
+	recording.Close()
+
+	// cut off the last frame partway through
+	data, _ := ioutil.ReadFile(fn)
+	ioutil.WriteFile(fn, data[:len(data)-2], 0644)
+	header, frames, times := readTestRecording(t, fn)
+	if !header.StartTime.Equal(time.Unix(100, 0)) || len(frames) != 1 || !times[0].Equal(time.Unix(100, 5)) {
+		t.Errorf("truncated recording: %+v, %v, %v", header, frames, times)
+	}
+
+	ioutil.WriteFile(fn, []byte("[{\"point\": [0, 0, 0]}]"), 0644)
+	if _, err := OpenRecording(fn); err == nil {
+		t.Errorf("OpenRecording should reject files which aren't recordings")
+	}
+}
+
+func TestRecordingPixelLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "show.rec")
+
+	// a corrupt header which claims far too many pixels
+	recording, err := CreateRecording(fn, RecordingHeader{NPixels: RECORDING_MAX_PIXELS + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording.Close()
+	if reader, err := OpenRecording(fn); err == nil {
+		reader.Close()
+		t.Errorf("OpenRecording should reject recordings with more than %v pixels", RECORDING_MAX_PIXELS)
+	}
+
+	// a frame too small for the recording
+	recording, _ = CreateRecording(fn, RecordingHeader{NPixels: 2})
+	recording.WriteFrame(time.Time{}, []byte{1, 2, 3, 4, 5, 6})
+	recording.Close()
+	reader, err := OpenRecording(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := reader.ReadFrame(make([]byte, 3)); err == nil || err == io.EOF {
+		t.Errorf("ReadFrame into a frame which is too small: err = %v", err)
+	}
+}
+
+//================================================================================
+// PLAYBACK
+
+// Write a recording of 2 pixels with one frame every 100 ms, where frame ii has all its
+// bytes set to ii+1.
+func makeTestRecording(t *testing.T, fn string, nFrames int) {
+	start := time.Unix(1000, 0)
+	recording, err := CreateRecording(fn, RecordingHeader{NPixels: 2, StartTime: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recording.Close()
+	for ii := 0; ii < nFrames; ii++ {
+		frame := bytes.Repeat([]byte{byte(ii + 1)}, 6)
+		recording.WriteFrame(start.Add(time.Duration(ii)*100*time.Millisecond), frame)
+	}
+}
+
+func TestRecordingPlayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "show.rec")
+	makeTestRecording(t, fn, 5)
+
+	cases := []struct {
+		seek     time.Duration
+		position time.Duration
+		frame    byte
+		ended    bool
+	}{
+		{0, 0, 1, false},
+		{0, 99 * time.Millisecond, 1, false},
+		{0, 100 * time.Millisecond, 2, false},
+		{0, 350 * time.Millisecond, 4, false},
+		{0, 400 * time.Millisecond, 5, true},
+		{0, time.Hour, 5, true},
+		{250 * time.Millisecond, 0, 3, false},
+		{250 * time.Millisecond, 300 * time.Millisecond, 4, false},
+	}
+	for _, c := range cases {
+		player, err := openRecordingPlayer(fn, c.seek)
+		if err != nil {
+			t.Fatalf("openRecordingPlayer failed: %v", err)
+		}
+		player.advanceTo(c.position)
+		if player.current[0] != c.frame || player.ended != c.ended {
+			t.Errorf("seek %v, position %v: frame %v ended %v; want frame %v ended %v",
+				c.seek, c.position, player.current[0], player.ended, c.frame, c.ended)
+		}
+		player.close()
+	}
+
+	// seeking right to the last frame is fine, but past it there's nothing to play
+	if player, err := openRecordingPlayer(fn, 400*time.Millisecond); err != nil || player.current[0] != 5 {
+		t.Errorf("seeking to the last frame: %v", err)
+	} else {
+		player.close()
+	}
+	if player, err := openRecordingPlayer(fn, 401*time.Millisecond); err == nil {
+		player.close()
+		t.Errorf("openRecordingPlayer should refuse to seek past the last frame")
+	}
+	makeTestRecording(t, fn, 0)
+	if player, err := openRecordingPlayer(fn, 0); err == nil {
+		player.close()
+		t.Errorf("openRecordingPlayer should refuse a recording with no frames")
+	}
+}
+
+func TestPlaybackThread(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "show.rec")
+	makeTestRecording(t, fn, 3)
+	layout, _ := ParseLayout([]byte(`[{"point": [0, 0, 0]}, {"point": [1, 0, 0]}, {"point": [2, 0, 0]}]`))
+
+	cases := []struct {
+		settings PlaybackSettings
+		want     []byte
+	}{
+		// one recorded frame per frame, holding the last one
+		{PlaybackSettings{Timing: PLAYBACK_TIMING_FPS}, []byte{1, 2, 3, 3, 3}},
+		// looping goes back to the seek point
+		{PlaybackSettings{Timing: PLAYBACK_TIMING_FPS, Loop: true}, []byte{1, 2, 3, 1, 2, 3, 1}},
+		{PlaybackSettings{Timing: PLAYBACK_TIMING_FPS, Loop: true, Seek: 0.1}, []byte{2, 3, 2, 3}},
+		// so fast that every frame is the end of the recording
+		{PlaybackSettings{Timing: PLAYBACK_TIMING_RECORDED, Speed: 1e9}, []byte{3, 3, 3}},
+		// so slow that it never gets past the first frame
+		{PlaybackSettings{Timing: PLAYBACK_TIMING_RECORDED, Speed: 1e-9}, []byte{1, 1, 1}},
+	}
+	for _, c := range cases {
+		bytesIn := make(chan []byte)
+		bytesOut := make(chan []byte)
+		go MakePlaybackThread(fn, layout, c.settings)(bytesIn, bytesOut, &midi.MidiState{})
+		got := make([]byte, 0)
+		for range c.want {
+			// the layout has one more pixel than the recording, which is padded with black
+			frame := requestFrame(t, bytesIn, bytesOut, 3)
+			if frame[6] != 0 || frame[0] != frame[5] {
+				t.Errorf("%+v: frame %v", c.settings, frame)
+			}
+			got = append(got, frame[0])
+		}
+		close(bytesIn)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%+v: played frames %v, want %v", c.settings, got, c.want)
+		}
+	}
+}
+
+//================================================================================
+// FRAME CLOCK
+
+func TestFixedStepClock(t *testing.T) {
+	clock := MakeFixedStepClock(10, 4)
+	for ff, want := range []FrameContext{{10, 0, 0}, {10.25, 0.25, 1}, {10.5, 0.25, 2}} {
+		if got := clock.Tick(); got != want {
+			t.Errorf("frame %v: got %+v, want %+v", ff, got, want)
+		}
+	}
+}
+
+func TestRealTimeClock(t *testing.T) {
+	clock := MakeRealTimeClock()
+	now := float64(time.Now().UnixNano())/1.0e9 - PATTERN_TIME_OFFSET
+	first := clock.Tick()
+	if first.Delta != 0 || first.Frame != 0 || math.Abs(first.Time-now) > 1 {
+		t.Errorf("first frame was %+v, want time about %v", first, now)
+	}
+	time.Sleep(10 * time.Millisecond)
+	second := clock.Tick()
+	if second.Frame != 1 || second.Delta < 0.01 || second.Delta != second.Time-first.Time {
+		t.Errorf("second frame was %+v after %+v", second, first)
+	}
+}
+
+func TestPatternsFollowShowTime(t *testing.T) {
+	// shield moves on by the frame delta, so it should reach the same place at the same show
+	// time however many frames it takes to get there
+	locations := MakeCircleLayout(1, 20, true).Locations()
+	slow := RenderFrames(MakePatternShield(locations), 20, 3, 4, 0)
+	fast := RenderFrames(MakePatternShield(locations), 20, 5, 8, 0)
+	if !bytes.Equal(slow[2], fast[4]) {
+		t.Errorf("shield looked different half a second in at 4 and 8 fps")
+	}
+	if bytes.Equal(slow[0], slow[2]) {
+		t.Errorf("shield didn't move")
+	}
+}
+
+//================================================================================
+// RENDERING
+
+func TestRenderFrames(t *testing.T) {
+	locations := MakeCircleLayout(1, 20, true).Locations()
+	render := func(startTime float64) [][]byte {
+		return RenderFrames(MakePatternSpatialStripes(locations), 20, 3, 10, startTime)
+	}
+	before := FrameContext{Time: 1, Delta: 2, Frame: 3}
+	SetFrameContext(before)
+	defer SetFrameContext(FrameContext{})
+	first := render(5)
+	second := render(5)
+	later := render(5.1)
+	if len(first) != 3 || len(first[0]) != 20*3 {
+		t.Fatalf("rendered %v frames of %v bytes", len(first), len(first[0]))
+	}
+	for ff := range first {
+		if !bytes.Equal(first[ff], second[ff]) {
+			t.Errorf("frame %v changed between renders", ff)
+		}
+	}
+	// the clock moves on a tenth of a second per frame
+	if !bytes.Equal(first[1], later[0]) || bytes.Equal(first[0], first[1]) {
+		t.Errorf("frames didn't follow the simulated clock")
+	}
+	if CurrentFrame() != before {
+		t.Errorf("RenderFrames left the frame context at %+v", CurrentFrame())
+	}
+}
+
+func TestMakeTimelineImage(t *testing.T) {
+	frames := [][]byte{{255, 0, 0, 0, 255, 0}, {0, 0, 255, 10, 20, 30}}
+	img := MakeTimelineImage(frames, 2)
+	if img.Bounds().Dx() != 4 || img.Bounds().Dy() != 4 {
+		t.Fatalf("timeline is %v", img.Bounds())
+	}
+	cases := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, color.RGBA{255, 0, 0, 255}},
+		{3, 1, color.RGBA{0, 255, 0, 255}},
+		{1, 2, color.RGBA{0, 0, 255, 255}},
+		{2, 3, color.RGBA{10, 20, 30, 255}},
+	}
+	for _, c := range cases {
+		if got := img.RGBAAt(c.x, c.y); got != c.want {
+			t.Errorf("timeline at %v, %v = %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+}
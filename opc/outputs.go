@@ -0,0 +1,107 @@
+package opc
+
+// Output map
+//   Split the frame between several outputs, each of which drives part of the layout.
+//   The map is a JSON file like this:
+//
+//	[
+//	  {"dest": "spi", "first": 0, "count": 800},
+//	  {"dest": "/dev/spidev2.0", "first": 800, "count": 600, "reverse": true},
+//	  {"dest": "192.168.1.10:7890", "first": 1400, "count": 200, "channel": 2}
+//	]
+//
+//   "dest" is anything --dest accepts.  Each output gets "count" pixels starting at "first";
+//   leave out "count" to go to the end of the layout.  "reverse" sends them last pixel first,
+//   for strips wired from the other end.  "channel" is the OPC channel to use when the output
+//   is an OPC server.  Outputs may overlap, so several can show the same pixels.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"io/ioutil"
+)
+
+// One output's share of the frame.
+type OutputMapping struct {
+	Dest string `json:"dest"`
+	PixelRange
+	Reverse bool `json:"reverse"`
+	Channel byte `json:"channel"`
+}
+
+// Read an output map from a JSON file and check it against the number of pixels in the layout.
+// Return an error if the file can't be parsed, has no outputs, or any range falls outside
+// of nPixels.
+func ReadOutputMap(fn string, nPixels int) ([]OutputMapping, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	outputMap, err := ParseOutputMap(data, nPixels)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	fmt.Printf("[opc.ReadOutputMap] Read %v outputs from %s\n", len(outputMap), fn)
+	return outputMap, nil
+}
+
+// Parse an output map from JSON.  See ReadOutputMap.
+func ParseOutputMap(data []byte, nPixels int) ([]OutputMapping, error) {
+	var outputMap []OutputMapping
+	if err := json.Unmarshal(data, &outputMap); err != nil {
+		return nil, err
+	}
+	if len(outputMap) == 0 {
+		return nil, fmt.Errorf("no outputs")
+	}
+	for ii := range outputMap {
+		output := &outputMap[ii]
+		if output.Dest == "" {
+			return nil, fmt.Errorf("output %v has no dest", ii)
+		}
+		if output.Count == 0 {
+			output.Count = nPixels - output.First
+		}
+		if output.First < 0 || output.Count < 1 || output.First+output.Count > nPixels {
+			return nil, fmt.Errorf("output %v (%s) covers pixels %v to %v but the layout only has %v pixels",
+				ii, output.Dest, output.First, output.First+output.Count-1, nPixels)
+		}
+	}
+	return outputMap, nil
+}
+
+// Copy the pixels in pixelRange out of frame into bytes, which should be long enough to hold
+// them, reversing their order if reverse is true.  Pixels past the end of the frame are black.
+func extractPixels(bytes []byte, frame []byte, pixelRange PixelRange, reverse bool) {
+	for ii := 0; ii < pixelRange.Count; ii++ {
+		jj := pixelRange.First + ii
+		if reverse {
+			jj = pixelRange.First + pixelRange.Count - 1 - ii
+		}
+		if jj*3+3 <= len(frame) {
+			copy(bytes[ii*3:ii*3+3], frame[jj*3:jj*3+3])
+		} else {
+			copy(bytes[ii*3:ii*3+3], []byte{0, 0, 0})
+		}
+	}
+}
+
+// Return a ByteThread which hands destThread just this output's pixels from each frame.
+// destThread gets its own byte slice, so the frame itself is never changed.
+func MakeOutputThread(output OutputMapping, destThread ByteThread) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		toDest := make(chan []byte, 0)
+		fromDest := make(chan []byte, 0)
+		go destThread(toDest, fromDest, midiState)
+		defer close(toDest)
+
+		outputBytes := make([]byte, output.Count*3)
+		for bytes := range bytesIn {
+			extractPixels(outputBytes, bytes, output.PixelRange, output.Reverse)
+			toDest <- outputBytes
+			outputBytes = <-fromDest
+			bytesOut <- bytes
+		}
+	}
+}
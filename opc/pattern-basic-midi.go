@@ -7,7 +7,6 @@ package opc
 import (
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
-	"time"
 )
 
 func MakePatternBasicMidi(locations []float64) ByteThread {
@@ -29,11 +28,9 @@ func MakePatternBasicMidi(locations []float64) ByteThread {
 		// smoothed value: like keyVolumes, but fades away slowly when key is off
 		smoothedVolumes := make([]float64, 128)
 
-		last_t := float64(0)
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
-			tDiff := colorutils.Clamp(t-last_t, 0, 5) // limit to max of 5 second to avoid pathological value at startup
+			tDiff := colorutils.Clamp(CurrentFrame().Delta, 0, 5) // limit to max of 5 second in case a frame stalls
 
 			// update keyVolumes from MidiState
 			if !SUSTAIN {
@@ -136,7 +133,6 @@ func MakePatternBasicMidi(locations []float64) ByteThread {
 				//--------------------------------------------------------------------------------
 			}
 
-			last_t = t
 			bytesOut <- bytes
 		}
 	}
@@ -9,7 +9,6 @@ import (
 	"github.com/longears/pixelslinger/midi"
 	"math"
 	"math/rand"
-	"time"
 )
 
 func MakePatternEye(locations []float64) ByteThread {
@@ -48,6 +47,9 @@ func MakePatternEye(locations []float64) ByteThread {
 			TOP_EYELID_MAX_CLOSE  = 0.55 // 0 is open, 1 is closed
 		)
 
+		// our own random numbers, so the eye moves the same way every time
+		rng := rand.New(rand.NewSource(99))
+
 		lastPupilTheta := 90.0
 		nextPupilTheta := 90.0
 		lastPupilTime := 0.0
@@ -60,7 +62,7 @@ func MakePatternEye(locations []float64) ByteThread {
 			if n_pixels > 160 {
 				n_pixels = 160
 			}
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := CurrentFrame().Time
 
 			// if the current move is over, figure out the next move
 			var moveDuration float64
@@ -68,7 +70,7 @@ func MakePatternEye(locations []float64) ByteThread {
 				holdingStill = 1 - holdingStill
 
 				// is this a big move or a small move?
-				bigMove := rand.Float64() < BIG_MOVE_PROB
+				bigMove := rng.Float64() < BIG_MOVE_PROB
 
 				lastPupilTheta = nextPupilTheta
 				if holdingStill == 0 {
@@ -76,20 +78,20 @@ func MakePatternEye(locations []float64) ByteThread {
 					if bigMove {
 						// big move
 						randomSign := 1.0
-						if rand.Float64() < 0.5 {
+						if rng.Float64() < 0.5 {
 							randomSign = -1.0
 						}
-						nextPupilTheta = lastPupilTheta + colorutils.Remap(rand.Float64(), 0, 1, MIN_BIG_MOVE_THETA, MAX_BIG_MOVE_THETA)*randomSign
+						nextPupilTheta = lastPupilTheta + colorutils.Remap(rng.Float64(), 0, 1, MIN_BIG_MOVE_THETA, MAX_BIG_MOVE_THETA)*randomSign
 					} else {
 						// small move
-						nextPupilTheta = lastPupilTheta + (rand.Float64()*2-1)*SMALL_MOVE_THETA
+						nextPupilTheta = lastPupilTheta + (rng.Float64()*2-1)*SMALL_MOVE_THETA
 					}
 					nextPupilTheta = colorutils.Clamp(nextPupilTheta, 1, 359)
 					//nextPupilTheta = colorutils.PosMod(nextPupilTheta, 360)
 				}
 
 				if holdingStill == 1 {
-					moveDuration = rand.Float64()*0.3 + 0.1
+					moveDuration = rng.Float64()*0.3 + 0.1
 				} else {
 					moveDuration = math.Abs(nextPupilTheta-lastPupilTheta)/180*0.2 + 0.05
 				}
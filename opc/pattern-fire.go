@@ -9,7 +9,6 @@ import (
 	"github.com/longears/pixelslinger/config"
 	"github.com/longears/pixelslinger/midi"
     "math"
-	"time"
 )
 
 // this is used to cache some per-pixel calculations
@@ -79,7 +78,6 @@ func MakePatternFire(locations []float64) ByteThread {
     }
 
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
-        last_t := 0.0
         t := 0.0
 		for bytes := range bytesIn {
 
@@ -100,7 +98,6 @@ func MakePatternFire(locations []float64) ByteThread {
 			n_pixels := len(bytes) / 3
 
             // time and speed knob bookkeeping
-			this_t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
 			speedKnob := float64(midiState.ControllerValues[config.SPEED_KNOB]) / 127.0
             if speedKnob < 0.5 {
                 speedKnob = colorutils.RemapAndClamp(speedKnob, 0, 0.4, 0, 1)
@@ -110,10 +107,7 @@ func MakePatternFire(locations []float64) ByteThread {
 			if midiState.KeyVolumes[config.SLOWMO_PAD] > 0 {
                 speedKnob *=  0.25
             }
-            if last_t != 0 {
-                t += (this_t - last_t) * speedKnob * SPEED
-            }
-            last_t = this_t
+            t += CurrentFrame().Delta * speedKnob * SPEED
 
 			// fill in bytes array
 			var r, g, b float64
@@ -9,14 +9,13 @@ import (
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"math"
-	"time"
 )
 
 func MakePatternJapan(locations []float64) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := CurrentFrame().Time
 
 			var (
 				NUM_BEAMS  = 5.0
@@ -8,7 +8,6 @@ import (
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/config"
 	"github.com/longears/pixelslinger/midi"
-	"time"
 )
 
 func MakePatternMidiSwitcher(locations []float64) ByteThread {
@@ -32,7 +31,7 @@ func MakePatternMidiSwitcher(locations []float64) ByteThread {
 
 		var patternName, lastPatternName string
 		for bytes := range bytesIn {
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := CurrentFrame().Time
 
 			// decide which subpattern we want for this frame
 
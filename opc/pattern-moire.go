@@ -6,7 +6,6 @@ package opc
 import (
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
-	"time"
 )
 
 func MakePatternMoire(locations []float64) ByteThread {
@@ -43,7 +42,7 @@ func MakePatternMoire(locations []float64) ByteThread {
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := CurrentFrame().Time
 
 			// fill in bytes slice
 			for ii := 0; ii < n_pixels; ii++ {
@@ -11,7 +11,6 @@ import (
 	"math"
 	"math/rand"
 	"os"
-	"time"
 )
 
 func handleErr(err error) {
@@ -124,10 +123,13 @@ func (mi *MyImage) getInterpolatedColor(x, y float64, wrapMethod string) (r, g,
 //================================================================================
 // PIXEL PATTERN
 
+// Where the sky picture is.  Relative paths are from the working directory, which for
+// pixelslinger is the top of the repo.
+var SUNSET_IMG_PATH = "images/sky4_square.png"
+
 func MakePatternSunset(locations []float64) ByteThread {
 
 	var (
-		IMG_PATH            = "images/sky4_square.png"
 		DAY_LENGTH          = 20.0 // seconds
 		SUN_SOFT_EDGE       = 0.2
 		STAR_BRIGHTNESS_EXP = 2.7 // higher number means fewer bright stars
@@ -161,16 +163,14 @@ func MakePatternSunset(locations []float64) ByteThread {
 
 	// load image
 	myImage := &MyImage{}
-	myImage.populateFromImage(IMG_PATH)
+	myImage.populateFromImage(SUNSET_IMG_PATH)
 
 	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
-		last_t := 0.0
 		t := 0.0
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
 
 			// time and speed knob bookkeeping
-			this_t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
 			speedKnob := float64(midiState.ControllerValues[config.SPEED_KNOB]) / 127.0
 			if speedKnob < 0.5 {
 				speedKnob = colorutils.RemapAndClamp(speedKnob, 0, 0.4, 0, 1)
@@ -180,10 +180,7 @@ func MakePatternSunset(locations []float64) ByteThread {
 			if midiState.KeyVolumes[config.SLOWMO_PAD] > 0 {
 				speedKnob *= 0.25
 			}
-			if last_t != 0 {
-				t += (this_t - last_t) * speedKnob
-			}
-			last_t = this_t
+			t += CurrentFrame().Delta * speedKnob
 
 			for ii := 0; ii < n_pixels; ii++ {
 				//--------------------------------------------------------------------------------
@@ -15,7 +15,6 @@ import (
 	"github.com/longears/pixelslinger/colorutils"
 	"github.com/longears/pixelslinger/midi"
 	"math/rand"
-	"time"
 )
 
 func MakePatternTest(locations []float64) ByteThread {
@@ -23,7 +22,7 @@ func MakePatternTest(locations []float64) ByteThread {
 		rng := rand.New(rand.NewSource(99))
 		for bytes := range bytesIn {
 			n_pixels := len(bytes) / 3
-			t := float64(time.Now().UnixNano())/1.0e9 - 9.4e8
+			t := CurrentFrame().Time
 
 			// fill in bytes array
 			var r, g, b float64
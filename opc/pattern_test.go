@@ -0,0 +1,198 @@
+package opc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//================================================================================
+// GOLDEN FRAMES
+
+// Each pattern is rendered on each layout for a few frames of simulated time starting here, and
+// the frames are compared with the timelines in testdata/patterns/<pattern>/<layout>.png.
+// The start time is when a wave of sailor-moon sparkles is going by, so it isn't all black.
+const (
+	GOLDEN_START_TIME = 1334.0
+	GOLDEN_FPS        = 2
+	GOLDEN_FRAMES     = 4
+)
+
+// How far a color channel may be from the golden frame before the test fails.  Some CPUs round
+// float math a little differently, which can nudge a channel over the line to the next byte.
+const GOLDEN_TOLERANCE = 2
+
+// The top of the repo, from the opc directory the tests run in.
+const REPO_ROOT = ".."
+
+// Return the layout files in the layouts directory under root, sorted.
+func goldenLayoutFiles(t *testing.T, root string) []string {
+	fns, err := filepath.Glob(filepath.Join(root, "layouts", "*.json"))
+	if err != nil || len(fns) == 0 {
+		t.Fatalf("couldn't find any layout files: %v", err)
+	}
+	layoutFns := []string{}
+	for _, fn := range fns {
+		if !strings.HasSuffix(fn, ".channels.json") && !strings.HasSuffix(fn, ".universes.json") {
+			layoutFns = append(layoutFns, fn)
+		}
+	}
+	sort.Strings(layoutFns)
+	return layoutFns
+}
+
+// Turn a timeline made by MakeTimelineImage with a scale of 1 back into frames.
+func timelineFrames(img image.Image) [][]byte {
+	bounds := img.Bounds()
+	frames := make([][]byte, bounds.Dy())
+	for ff := range frames {
+		frames[ff] = make([]byte, bounds.Dx()*3)
+		for ii := 0; ii < bounds.Dx(); ii++ {
+			c := color.RGBAModel.Convert(img.At(bounds.Min.X+ii, bounds.Min.Y+ff)).(color.RGBA)
+			frames[ff][ii*3+0] = c.R
+			frames[ff][ii*3+1] = c.G
+			frames[ff][ii*3+2] = c.B
+		}
+	}
+	return frames
+}
+
+func writeGoldenTimeline(fn string, frames [][]byte) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, MakeTimelineImage(frames, 1)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func readGoldenTimeline(fn string) ([][]byte, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return timelineFrames(img), nil
+}
+
+// Return a description of the first difference between got and want bigger than
+// GOLDEN_TOLERANCE, or "" if there isn't one.
+func compareGoldenFrames(got [][]byte, want [][]byte) string {
+	if len(got) != len(want) {
+		return fmt.Sprintf("got %v frames, want %v", len(got), len(want))
+	}
+	for ff := range got {
+		if len(got[ff]) != len(want[ff]) {
+			return fmt.Sprintf("frame %v has %v pixels, want %v", ff, len(got[ff])/3, len(want[ff])/3)
+		}
+		for ii := range got[ff] {
+			diff := int(got[ff][ii]) - int(want[ff][ii])
+			if diff > GOLDEN_TOLERANCE || diff < -GOLDEN_TOLERANCE {
+				pixel := ii / 3
+				return fmt.Sprintf("frame %v pixel %v is %v, want %v", ff, pixel, got[ff][pixel*3:pixel*3+3], want[ff][pixel*3:pixel*3+3])
+			}
+		}
+	}
+	return ""
+}
+
+func TestPatternGoldenFrames(t *testing.T) {
+	patternNames := []string{}
+	for name := range PATTERN_REGISTRY {
+		patternNames = append(patternNames, name)
+	}
+	sort.Strings(patternNames)
+
+	// sunset loads its picture from images/, which isn't under opc/
+	defer func(imgPath string) { SUNSET_IMG_PATH = imgPath }(SUNSET_IMG_PATH)
+	SUNSET_IMG_PATH = filepath.Join(REPO_ROOT, SUNSET_IMG_PATH)
+
+	goldenDir := filepath.Join("testdata", "patterns")
+	for _, layoutFn := range goldenLayoutFiles(t, REPO_ROOT) {
+		layout, err := ReadLayout(layoutFn)
+		if err != nil {
+			t.Errorf("ReadLayout(%s) failed: %v", layoutFn, err)
+			continue
+		}
+		locations := layout.Locations()
+		layoutName := strings.TrimSuffix(filepath.Base(layoutFn), ".json")
+
+		for _, name := range patternNames {
+			goldenFn := filepath.Join(goldenDir, name, layoutName+".png")
+			frames := RenderFrames(PATTERN_REGISTRY[name](locations), len(layout.Pixels), GOLDEN_FRAMES, GOLDEN_FPS, GOLDEN_START_TIME)
+
+			if *updateGolden {
+				if err := writeGoldenTimeline(goldenFn, frames); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			want, err := readGoldenTimeline(goldenFn)
+			if err != nil {
+				t.Errorf("%s on %s: %v (run \"go test -update\" to make it)", name, layoutName, err)
+				continue
+			}
+			if problem := compareGoldenFrames(frames, want); problem != "" {
+				t.Errorf("%s on %s doesn't match %s: %s", name, layoutName, goldenFn, problem)
+			}
+		}
+	}
+}
+
+func TestCompareGoldenFrames(t *testing.T) {
+	want := [][]byte{{10, 20, 30, 40, 50, 60}}
+	if problem := compareGoldenFrames([][]byte{{10, 20, 30, 40, 50, 60}}, want); problem != "" {
+		t.Errorf("identical frames: %s", problem)
+	}
+	if problem := compareGoldenFrames([][]byte{{12, 18, 30, 40, 50, 61}}, want); problem != "" {
+		t.Errorf("frames within the tolerance: %s", problem)
+	}
+	if problem := compareGoldenFrames([][]byte{{10, 20, 30, 40, 53, 60}}, want); problem != "frame 0 pixel 1 is [40 53 60], want [40 50 60]" {
+		t.Errorf("frames outside the tolerance: %q", problem)
+	}
+	if problem := compareGoldenFrames([][]byte{{10, 20, 30}}, want); problem == "" {
+		t.Errorf("frames of different sizes should differ")
+	}
+	if problem := compareGoldenFrames(nil, want); problem == "" {
+		t.Errorf("different numbers of frames should differ")
+	}
+}
+
+func TestGoldenTimelineRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "pattern", "layout.png")
+	frames := [][]byte{makeTestFrame(7), makeTestFrame(7)}
+	frames[1][0] = 99
+	if err := writeGoldenTimeline(fn, frames); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readGoldenTimeline(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !bytes.Equal(got[0], frames[0]) || !bytes.Equal(got[1], frames[1]) {
+		t.Errorf("frames changed on the way through a PNG:\ngot  %v\nwant %v", got, frames)
+	}
+}
@@ -0,0 +1,253 @@
+package opc
+
+// Pixel formats
+//   Different strips in the same installation can want their colors in a different order, or
+//   have a different white point (say, because some are mounted on white backing which makes
+//   them look bluer).  The layout file can give each group of pixels a format which every
+//   output driver applies on the way out:
+//
+//	"formats": {
+//	  "arch": {"color_order": "BRG", "white_balance": [1, 0.8, 0.7]},
+//	  "back": {"color_temperature": 4500}
+//	}
+//
+//   "color_order" is the order the strip expects its colors in; without it, the output driver
+//   uses its chipset's usual order.  "white_balance" multiplies the light output of red, green,
+//   and blue.  "color_temperature" is another way to set the white balance: it makes full white
+//   look like the light from something that hot, in Kelvin.  6500 is neutral and lower numbers
+//   are warmer.  A pixel can only be in one group with a format.
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The color temperature of full white when there's no white balance
+const NEUTRAL_COLOR_TEMPERATURE = 6500 // Kelvin
+
+// How the colors of one pixel are adjusted for its strip on their way out.
+type PixelFormat struct {
+	ColorOrder   string     // like "GRB".  "" means the output's own color order
+	WhiteBalance [3]float64 // multipliers for r, g, and b, applied to the linear light output
+}
+
+// The PixelFormat for pixels which need no adjusting.
+var DEFAULT_PIXEL_FORMAT = PixelFormat{WhiteBalance: [3]float64{1, 1, 1}}
+
+// Parse one entry of a layout's "formats".
+func parsePixelFormat(data []byte) (PixelFormat, error) {
+	var formatJson struct {
+		ColorOrder       string    `json:"color_order"`
+		WhiteBalance     []float64 `json:"white_balance"`
+		ColorTemperature float64   `json:"color_temperature"`
+	}
+	pixelFormat := DEFAULT_PIXEL_FORMAT
+	if err := json.Unmarshal(data, &formatJson); err != nil {
+		return pixelFormat, err
+	}
+	if formatJson.ColorOrder != "" {
+		if _, err := parseColorOrder(formatJson.ColorOrder); err != nil {
+			return pixelFormat, err
+		}
+		pixelFormat.ColorOrder = strings.ToUpper(formatJson.ColorOrder)
+	}
+	if formatJson.WhiteBalance != nil && formatJson.ColorTemperature != 0 {
+		return pixelFormat, fmt.Errorf("can't have both a white_balance and a color_temperature")
+	}
+	if formatJson.WhiteBalance != nil {
+		if len(formatJson.WhiteBalance) != 3 {
+			return pixelFormat, fmt.Errorf("white_balance should have 3 numbers, not %v", len(formatJson.WhiteBalance))
+		}
+		for _, v := range formatJson.WhiteBalance {
+			if v < 0 {
+				return pixelFormat, fmt.Errorf("white_balance can't be negative")
+			}
+		}
+		copy(pixelFormat.WhiteBalance[:], formatJson.WhiteBalance)
+	}
+	if formatJson.ColorTemperature != 0 {
+		if formatJson.ColorTemperature < 1000 || formatJson.ColorTemperature > 40000 {
+			return pixelFormat, fmt.Errorf("color_temperature should be between 1000 and 40000 Kelvin")
+		}
+		pixelFormat.WhiteBalance = colorTemperatureWhiteBalance(formatJson.ColorTemperature)
+	}
+	return pixelFormat, nil
+}
+
+// Approximate color of a black body at the given temperature in Kelvin, as r, g, b from 0 to 1.
+// From Tanner Helland's curve fit to the CIE 1964 color matching functions.
+func blackBodyColor(kelvin float64) [3]float64 {
+	t := kelvin / 100
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	if t >= 66 {
+		b = 255
+	} else if t <= 19 {
+		b = 0
+	} else {
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	color := [3]float64{r / 255, g / 255, b / 255}
+	for cc := range color {
+		color[cc] = math.Max(0, math.Min(1, color[cc]))
+	}
+	return color
+}
+
+// Return the white balance which makes full white look like the given color temperature.
+// The brightest channel is always 1, so the white balance only ever dims.
+func colorTemperatureWhiteBalance(kelvin float64) [3]float64 {
+	color := blackBodyColor(kelvin)
+	neutral := blackBodyColor(NEUTRAL_COLOR_TEMPERATURE)
+	var whiteBalance [3]float64
+	max := 0.0
+	for cc := range whiteBalance {
+		// the white balance works on linear light output
+		whiteBalance[cc] = math.Pow(color[cc]/neutral[cc], GAMMA)
+		max = math.Max(max, whiteBalance[cc])
+	}
+	for cc := range whiteBalance {
+		whiteBalance[cc] /= max
+	}
+	return whiteBalance
+}
+
+// Turn a color order like "GRB" into the index of the r, g, or b value to send in each position.
+func parseColorOrder(colorOrder string) ([3]int, error) {
+	var order [3]int
+	if len(colorOrder) != 3 {
+		return order, fmt.Errorf("color order %q should be 3 letters like \"GRB\"", colorOrder)
+	}
+	seen := make(map[int]bool)
+	for ii, letter := range strings.ToUpper(colorOrder) {
+		cc := strings.IndexRune("RGB", letter)
+		if cc < 0 || seen[cc] {
+			return order, fmt.Errorf("color order %q should have each of R, G, and B once", colorOrder)
+		}
+		seen[cc] = true
+		order[ii] = cc
+	}
+	return order, nil
+}
+
+// Return the format of each pixel in the layout.
+// Pixels which aren't in any group with a format get DEFAULT_PIXEL_FORMAT.
+func (layout *Layout) PixelFormats() []PixelFormat {
+	pixelFormats := make([]PixelFormat, len(layout.Pixels))
+	for ii := range pixelFormats {
+		pixelFormats[ii] = DEFAULT_PIXEL_FORMAT
+	}
+	for name, pixelFormat := range layout.Formats {
+		for _, pixelRange := range layout.Groups[name] {
+			for ii := pixelRange.First; ii < pixelRange.First+pixelRange.Count; ii++ {
+				pixelFormats[ii] = pixelFormat
+			}
+		}
+	}
+	return pixelFormats
+}
+
+// Check that every format belongs to a group and that no pixel is in two groups with formats.
+func (layout *Layout) checkFormats() error {
+	names := make([]string, 0, len(layout.Formats))
+	for name := range layout.Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formattedBy := make([]string, len(layout.Pixels))
+	for _, name := range names {
+		pixelRanges, ok := layout.Groups[name]
+		if !ok {
+			return fmt.Errorf("there's a format for %q but no group with that name", name)
+		}
+		for _, pixelRange := range pixelRanges {
+			for ii := pixelRange.First; ii < pixelRange.First+pixelRange.Count; ii++ {
+				if formattedBy[ii] != "" && formattedBy[ii] != name {
+					return fmt.Errorf("pixel %v is in both %q and %q, which both have formats", ii, formattedBy[ii], name)
+				}
+				formattedBy[ii] = name
+			}
+		}
+	}
+	return nil
+}
+
+// Applies PixelFormats to pixels on their way out.
+type pixelFormatter struct {
+	orders       [][3]int // color order of each pixel
+	balances     [][3]float64
+	order        [3]int    // color order of pixels past the end of orders
+	gamma_lookup []float64 // linear light output for each byte value, from 0 to 1
+}
+
+// Prepare to format pixels for an output whose colors usually go in defaultColorOrder.
+// pixelFormats has the format of each pixel; pixels past the end of it use DEFAULT_PIXEL_FORMAT.
+// Return an error if any color order is invalid.
+func newPixelFormatter(defaultColorOrder string, pixelFormats []PixelFormat) (*pixelFormatter, error) {
+	order, err := parseColorOrder(defaultColorOrder)
+	if err != nil {
+		return nil, err
+	}
+	formatter := &pixelFormatter{
+		orders:       make([][3]int, len(pixelFormats)),
+		balances:     make([][3]float64, len(pixelFormats)),
+		order:        order,
+		gamma_lookup: make([]float64, 256),
+	}
+	for ii := range formatter.gamma_lookup {
+		formatter.gamma_lookup[ii] = math.Pow(float64(ii)/255, GAMMA)
+	}
+	for ii, pixelFormat := range pixelFormats {
+		formatter.orders[ii] = order
+		if pixelFormat.ColorOrder != "" {
+			if formatter.orders[ii], err = parseColorOrder(pixelFormat.ColorOrder); err != nil {
+				return nil, err
+			}
+		}
+		formatter.balances[ii] = pixelFormat.WhiteBalance
+	}
+	return formatter, nil
+}
+
+// Apply the white balance of pixel ii to its linear r, g, b light output and return the
+// result in the pixel's color order.
+func (formatter *pixelFormatter) format(ii int, rgb [3]float64) [3]float64 {
+	order, balance := formatter.order, DEFAULT_PIXEL_FORMAT.WhiteBalance
+	if ii < len(formatter.orders) {
+		order, balance = formatter.orders[ii], formatter.balances[ii]
+	}
+	var color [3]float64
+	for pos, cc := range order {
+		color[pos] = rgb[cc] * balance[cc]
+	}
+	return color
+}
+
+// Gamma correct the bytes and apply the pixel formats, writing the result to out, which
+// should be at least as long as bytes.  out can be bytes itself.
+// This is for outputs whose devices take linear 8-bit values, like OPC servers.
+func (formatter *pixelFormatter) formatBytes(out []byte, bytes []byte) {
+	for ii := 0; ii < len(bytes)-2; ii += 3 {
+		rgb := [3]float64{
+			formatter.gamma_lookup[bytes[ii+0]],
+			formatter.gamma_lookup[bytes[ii+1]],
+			formatter.gamma_lookup[bytes[ii+2]],
+		}
+		for cc, v := range formatter.format(ii/3, rgb) {
+			if v >= 1 {
+				out[ii+cc] = 255
+			} else {
+				out[ii+cc] = byte(v * 256)
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package opc
+
+// Playback
+//   A source which plays back a recording made with MakeSendToRecordingThread, for rehearsing a
+//   show or comparing runs without the MIDI hardware.
+//   Frames come out at the times they were recorded (sped up or slowed down if you like), or one
+//   recorded frame per frame of the main loop.  Playback can start partway in and loop.
+
+import (
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"io"
+	"os"
+	"time"
+)
+
+// How a playback source decides which recorded frame to show
+const (
+	PLAYBACK_TIMING_RECORDED = "recorded" // the frame from the moment of the recording we've reached
+	PLAYBACK_TIMING_FPS      = "fps"      // the next frame, one per frame of the main loop
+)
+
+// Settings for the ByteThread returned by MakePlaybackThread.
+type PlaybackSettings struct {
+	Timing       string  // PLAYBACK_TIMING_RECORDED or PLAYBACK_TIMING_FPS
+	Speed        float64 // 1 is real time.  only used with PLAYBACK_TIMING_RECORDED
+	Seek         float64 // seconds into the recording to start from, and to go back to when looping
+	Loop         bool    // start over at the end instead of holding the last frame
+	ResizePolicy string  // one of the RESIZE_* constants, for recordings made with a different layout
+}
+
+// Steps through the frames of a recording.
+type recordingPlayer struct {
+	recording     *RecordingReader
+	current       []byte        // the frame to show
+	currentOffset time.Duration // when current was shown, from the start of the recording
+	pending       []byte        // the frame after current
+	pendingOffset time.Duration // when pending was shown, from the start of the recording
+	ended         bool          // true once there's no pending frame
+}
+
+// Open a recording and move to the frame which was showing at seek.
+// Return an error if the recording has no frames or seek is past the last one, since there'd be
+// nothing to play (or to loop back to).
+func openRecordingPlayer(fn string, seek time.Duration) (*recordingPlayer, error) {
+	recording, err := OpenRecording(fn)
+	if err != nil {
+		return nil, err
+	}
+	player := &recordingPlayer{
+		recording: recording,
+		current:   make([]byte, recording.Header.NPixels*3),
+		pending:   make([]byte, recording.Header.NPixels*3),
+	}
+	player.readPending()
+	if player.ended {
+		recording.Close()
+		return nil, fmt.Errorf("%s: recording has no frames", fn)
+	}
+	player.step()
+	player.advanceTo(seek)
+	if player.ended && seek > player.currentOffset {
+		recording.Close()
+		return nil, fmt.Errorf("%s: can't seek to %v; the last frame is at %v", fn, seek, player.currentOffset)
+	}
+	return player, nil
+}
+
+// Read the next frame from the file into pending.
+func (player *recordingPlayer) readPending() {
+	frameTime, err := player.recording.ReadFrame(player.pending)
+	if err != nil {
+		if err != io.EOF {
+			fmt.Println("[opc.PlaybackThread]", err)
+		}
+		player.ended = true
+		return
+	}
+	player.pendingOffset = frameTime.Sub(player.recording.Header.StartTime)
+}
+
+// Move on to the next frame, if there is one.
+func (player *recordingPlayer) step() {
+	if player.ended {
+		return
+	}
+	player.current, player.pending = player.pending, player.current
+	player.currentOffset = player.pendingOffset
+	player.readPending()
+}
+
+// Move on to the last frame shown at or before position, measured from the start of the recording.
+func (player *recordingPlayer) advanceTo(position time.Duration) {
+	for !player.ended && player.pendingOffset <= position {
+		player.step()
+	}
+}
+
+func (player *recordingPlayer) close() {
+	player.recording.Close()
+}
+
+// Return a ByteThread which plays back the recording in the file fn.
+// If the recording was made with a different layout, print a warning, and if it has a different
+// number of pixels, make it fit according to settings.ResizePolicy.
+// If the file can't be read, exit the whole program with exit status 1.
+func MakePlaybackThread(fn string, layout *Layout, settings PlaybackSettings) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		fmt.Println("[opc.PlaybackThread] starting up:", fn)
+
+		seek := time.Duration(settings.Seek * float64(time.Second))
+		player, err := openRecordingPlayer(fn, seek)
+		if err != nil {
+			fmt.Println("[opc.PlaybackThread] Error:", err)
+			os.Exit(1)
+		}
+		defer func() {
+			player.close()
+		}()
+		header := player.recording.Header
+		if header.NPixels != len(layout.Pixels) {
+			fmt.Printf("[opc.PlaybackThread] recording has %v pixels; layout has %v (%s)\n", header.NPixels, len(layout.Pixels), settings.ResizePolicy)
+		} else if header.LayoutHash != layout.Hash() {
+			fmt.Println("[opc.PlaybackThread] warning: recording was made with a different layout")
+		}
+
+		var startTime time.Time
+		for bytes := range bytesIn {
+			if startTime.IsZero() {
+				startTime = time.Now()
+			}
+			if settings.Timing != PLAYBACK_TIMING_FPS {
+				elapsed := time.Duration(float64(time.Since(startTime)) * settings.Speed)
+				player.advanceTo(seek + elapsed)
+			}
+			fitPixels(bytes, player.current, settings.ResizePolicy)
+
+			if player.ended && settings.Loop {
+				// start over from the seek point
+				player.close()
+				if player, err = openRecordingPlayer(fn, seek); err != nil {
+					fmt.Println("[opc.PlaybackThread] Error:", err)
+					os.Exit(1)
+				}
+				startTime = time.Now()
+			} else if settings.Timing == PLAYBACK_TIMING_FPS {
+				player.step()
+			}
+			bytesOut <- bytes
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package opc
+
+// Recording
+//   A destination which saves every frame to a file, so a show can be analysed or played back
+//   later.  The file is a header followed by one record per frame:
+//
+//	header:  "PXREC", version (1 byte), pixel count (uint32), layout hash (32 bytes),
+//	         start time in Unix nanoseconds (int64)
+//	frame:   nanoseconds since the start time (uint64), then 3 bytes per pixel
+//
+//   All numbers are big-endian.  The frames are the pixels as they come out of the effects,
+//   before gamma correction or pixel formats.  If the filename ends in ".gz" the whole file is
+//   gzipped.  Each frame is flushed to the file as soon as it's written, so a recording which
+//   is cut off when pixelslinger is killed can still be read, up to the last whole frame.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const RECORDING_MAGIC = "PXREC"
+const RECORDING_VERSION = 1
+const RECORDING_GZIP_SUFFIX = ".gz"
+
+// The most pixels a recording may have.  A header which says more is corrupt, and believing it
+// would mean allocating a huge frame.
+const RECORDING_MAX_PIXELS = 1 << 20
+
+// What a recording says about itself.
+type RecordingHeader struct {
+	NPixels    int
+	LayoutHash [sha256.Size]byte // see Layout.Hash
+	StartTime  time.Time
+}
+
+// Writes frames to a recording file.
+type RecordingWriter struct {
+	header RecordingHeader
+	file   *os.File
+	gz     *gzip.Writer // nil if the file isn't compressed
+	writer *bufio.Writer
+}
+
+// Create a recording file and write its header.  It's gzipped if fn ends in ".gz".
+func CreateRecording(fn string, header RecordingHeader) (*RecordingWriter, error) {
+	file, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	recording := &RecordingWriter{header: header, file: file}
+	if strings.HasSuffix(fn, RECORDING_GZIP_SUFFIX) {
+		recording.gz = gzip.NewWriter(file)
+		recording.writer = bufio.NewWriter(recording.gz)
+	} else {
+		recording.writer = bufio.NewWriter(file)
+	}
+	recording.writer.WriteString(RECORDING_MAGIC)
+	recording.writer.WriteByte(RECORDING_VERSION)
+	binary.Write(recording.writer, binary.BigEndian, uint32(header.NPixels))
+	recording.writer.Write(header.LayoutHash[:])
+	binary.Write(recording.writer, binary.BigEndian, header.StartTime.UnixNano())
+	if err := recording.flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return recording, nil
+}
+
+// Push everything written so far out to the file.
+func (recording *RecordingWriter) flush() error {
+	if err := recording.writer.Flush(); err != nil {
+		return err
+	}
+	if recording.gz != nil {
+		return recording.gz.Flush()
+	}
+	return nil
+}
+
+// Write a frame which was shown at the given time.
+// Return an error if the frame has the wrong number of pixels or the write fails.
+func (recording *RecordingWriter) WriteFrame(frameTime time.Time, bytes []byte) error {
+	if len(bytes) != recording.header.NPixels*3 {
+		return fmt.Errorf("frame has %v pixels but the recording has %v", len(bytes)/3, recording.header.NPixels)
+	}
+	binary.Write(recording.writer, binary.BigEndian, uint64(frameTime.Sub(recording.header.StartTime)))
+	recording.writer.Write(bytes)
+	return recording.flush()
+}
+
+// Finish the file and close it.
+func (recording *RecordingWriter) Close() error {
+	err := recording.flush()
+	if recording.gz != nil {
+		if gzErr := recording.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := recording.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Reads frames from a recording file.
+type RecordingReader struct {
+	Header RecordingHeader
+	file   *os.File
+	reader io.Reader
+}
+
+// Open a recording file and read its header.  Gzipped files are recognized by their contents,
+// whatever their names.
+func OpenRecording(fn string) (*RecordingReader, error) {
+	file, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := readRecordingHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	recording.file = file
+	return recording, nil
+}
+
+// Start reading a recording, which may be gzipped, from r.
+func readRecordingHeader(r io.Reader) (*RecordingReader, error) {
+	buffered := bufio.NewReader(r)
+	recording := &RecordingReader{reader: buffered}
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		recording.reader = bufio.NewReader(gz)
+	}
+	var header struct {
+		Magic      [len(RECORDING_MAGIC)]byte
+		Version    byte
+		NPixels    uint32
+		LayoutHash [sha256.Size]byte
+		StartTime  int64
+	}
+	if err := binary.Read(recording.reader, binary.BigEndian, &header); err != nil || string(header.Magic[:]) != RECORDING_MAGIC {
+		return nil, fmt.Errorf("not a pixelslinger recording")
+	}
+	if header.Version != RECORDING_VERSION {
+		return nil, fmt.Errorf("recording is version %v but we only understand version %v", header.Version, RECORDING_VERSION)
+	}
+	if header.NPixels > RECORDING_MAX_PIXELS {
+		return nil, fmt.Errorf("recording says it has %v pixels, more than the %v allowed", header.NPixels, RECORDING_MAX_PIXELS)
+	}
+	recording.Header = RecordingHeader{
+		NPixels:    int(header.NPixels),
+		LayoutHash: header.LayoutHash,
+		StartTime:  time.Unix(0, header.StartTime),
+	}
+	return recording, nil
+}
+
+// Read the next frame into bytes, which should have room for Header.NPixels pixels, and return
+// the time it was shown.
+// Return io.EOF after the last whole frame, or an error if bytes is too small.
+func (recording *RecordingReader) ReadFrame(bytes []byte) (time.Time, error) {
+	if len(bytes) < recording.Header.NPixels*3 {
+		return time.Time{}, fmt.Errorf("frame has room for %v pixels but the recording has %v", len(bytes)/3, recording.Header.NPixels)
+	}
+	var offset uint64
+	if err := binary.Read(recording.reader, binary.BigEndian, &offset); err != nil {
+		return time.Time{}, recordingEOF(err)
+	}
+	if _, err := io.ReadFull(recording.reader, bytes[:recording.Header.NPixels*3]); err != nil {
+		return time.Time{}, recordingEOF(err)
+	}
+	return recording.Header.StartTime.Add(time.Duration(offset)), nil
+}
+
+// A recording which was cut off partway through a frame just ends there.
+func recordingEOF(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// Close the file.
+func (recording *RecordingReader) Close() error {
+	return recording.file.Close()
+}
+
+// Return the time of a frame from the frame clock as a time.Time.  For a real-time clock that's
+// when the frame was computed.
+func frameClockTime(ctx FrameContext) time.Time {
+	return time.Unix(int64(PATTERN_TIME_OFFSET), 0).Add(time.Duration(ctx.Time * 1e9))
+}
+
+// Return a ByteThread which records every frame to the file fn, along with the number of pixels
+// and the hash of the layout.  It passes the bytes along untouched, so it can be used alongside
+// other destinations with MakeFanOutThread.
+// Frames are stamped with their times from the frame clock (see CurrentFrame), so a show which
+// was rendered with a fixed-step clock plays back at the speed it was meant to, and the recording
+// starts at the time of the first frame.
+// If the file can't be created, exit the whole program with exit status 1.  If writing fails
+// later, say because the disk is full, print the error and stop recording.
+func MakeSendToRecordingThread(fn string, layout *Layout) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		fmt.Println("[opc.SendToRecordingThread] starting up:", fn)
+
+		var recording *RecordingWriter
+		stopped := false
+		defer func() {
+			if recording != nil {
+				recording.Close()
+			}
+		}()
+
+		for bytes := range bytesIn {
+			frameTime := frameClockTime(CurrentFrame())
+			if recording == nil && !stopped {
+				// the header needs the time of the first frame
+				var err error
+				recording, err = CreateRecording(fn, RecordingHeader{
+					NPixels:    len(layout.Pixels),
+					LayoutHash: layout.Hash(),
+					StartTime:  frameTime,
+				})
+				if err != nil {
+					fmt.Println("[opc.SendToRecordingThread] Error:", err)
+					os.Exit(1)
+				}
+			}
+			if recording != nil {
+				if err := recording.WriteFrame(frameTime, bytes); err != nil {
+					fmt.Println("[opc.SendToRecordingThread] stopping:", err)
+					recording.Close()
+					recording = nil
+					stopped = true
+				}
+			}
+			bytesOut <- bytes
+		}
+	}
+}
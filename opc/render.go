@@ -0,0 +1,59 @@
+package opc
+
+// Rendering
+//   Run a pattern without any LEDs and turn its frames into a picture, for previews: a timeline
+//   with one column per pixel and one row per frame.
+
+import (
+	"github.com/longears/pixelslinger/config"
+	"github.com/longears/pixelslinger/midi"
+	"image"
+	"image/color"
+)
+
+// Run the source for nFrames frames of nPixels each and return the frames.
+// Patterns see a simulated clock which starts at startTime seconds and moves on 1/fps seconds
+// each frame, however long the frames take to compute, and the MIDI knobs are left at their
+// default values.  Afterwards the frame context goes back to what it was.
+func RenderFrames(sourceThread ByteThread, nPixels int, nFrames int, fps float64, startTime float64) [][]byte {
+	clock := MakeFixedStepClock(startTime, fps)
+	defer SetFrameContext(CurrentFrame())
+
+	midiState := midi.MidiState{}
+	for knob, defaultVal := range config.DEFAULT_KNOB_VALUES {
+		midiState.ControllerValues[knob] = defaultVal
+	}
+	bytesIn := make(chan []byte, 0)
+	bytesOut := make(chan []byte, 0)
+	go sourceThread(bytesIn, bytesOut, &midiState)
+	defer close(bytesIn)
+
+	frames := make([][]byte, nFrames)
+	for ff := range frames {
+		SetFrameContext(clock.Tick())
+		bytesIn <- make([]byte, nPixels*3)
+		frames[ff] = <-bytesOut
+	}
+	return frames
+}
+
+// Make a picture of the frames with one column per pixel and one row per frame, so time goes
+// down the picture.  Each pixel of each frame is a square scale pixels wide.
+func MakeTimelineImage(frames [][]byte, scale int) *image.RGBA {
+	nPixels := 0
+	if len(frames) > 0 {
+		nPixels = len(frames[0]) / 3
+	}
+	img := image.NewRGBA(image.Rect(0, 0, nPixels*scale, len(frames)*scale))
+	for ff, frame := range frames {
+		for ii := 0; ii < nPixels; ii++ {
+			c := color.RGBA{frame[ii*3+0], frame[ii*3+1], frame[ii*3+2], 255}
+			for y := ff * scale; y < (ff+1)*scale; y++ {
+				for x := ii * scale; x < (ii+1)*scale; x++ {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return img
+}
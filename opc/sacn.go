@@ -0,0 +1,244 @@
+package opc
+
+// sACN
+//   Send frames to streaming ACN (ANSI E1.31) receivers as DMX over UDP.
+//   Like Art-Net, the frame is split into universes of 170 pixels, starting at a chosen universe.
+//   Each universe goes to one receiver (unicast) or to its own multicast group, which is
+//   239.255.x.y for universe number x*256+y.  Optionally a universe sync packet follows each frame
+//   so that receivers hold their universes until they've all arrived.
+//   The destination is a URL like "sacn://10.0.0.5?universe=1&priority=100&sync=7000", or
+//   "sacn://?universe=1" to multicast.
+//   See http://tsp.esta.org/tsp/documents/docs/ANSI_E1-31-2018.pdf
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const SACN_SCHEME = "sacn"
+const SACN_PORT = "5568"
+
+// Settings which can go in an sACN destination URL
+const (
+	SACN_MIN_UNIVERSE        = 1
+	SACN_MAX_UNIVERSE        = 63999
+	SACN_MAX_PRIORITY        = 200
+	SACN_DEFAULT_PRIORITY    = 100
+	SACN_DEFAULT_SOURCE_NAME = "pixelslinger"
+	SACN_SOURCE_NAME_SIZE    = 64 // bytes, including the terminating zero
+)
+
+// E1.31 packets
+const (
+	SACN_ACN_ID                      = "ASC-E1.17\x00\x00\x00"
+	SACN_VECTOR_ROOT_DATA     uint32 = 0x00000004
+	SACN_VECTOR_ROOT_EXTENDED uint32 = 0x00000008
+	SACN_VECTOR_FRAMING_DATA  uint32 = 0x00000002
+	SACN_VECTOR_FRAMING_SYNC  uint32 = 0x00000001
+	SACN_VECTOR_DMP_SET       byte   = 0x02
+	SACN_DMP_ADDRESS_TYPE     byte   = 0xa1
+	SACN_DATA_HEADER_SIZE            = 126 // bytes before the first channel value
+	SACN_SYNC_PACKET_SIZE            = 49
+	SACN_FLAGS                uint16 = 0x7000 // goes in the top 4 bits of each layer's length
+	SACN_ROOT_LAYER_START            = 16
+	SACN_FRAMING_LAYER_START         = 38
+	SACN_DMP_LAYER_START             = 115
+)
+
+// Where and how to send sACN.
+type SacnSettings struct {
+	Address      string // host:port of the receiver, or "" to multicast
+	Universe     int    // universe of the first pixel
+	Priority     int    // from 0 to 200; receivers listen to the source with the highest priority
+	SourceName   string // shown by receivers
+	Cid          [16]byte
+	SyncUniverse int // send universe sync packets on this universe after each frame, or 0 for none
+}
+
+// Parse a destination URL like "sacn://10.0.0.5:5568?universe=1&priority=100&name=tower&sync=7000".
+// Leave out the host, as in "sacn://?universe=1", to multicast.
+// The port defaults to SACN_PORT, the universe to 1, the priority to SACN_DEFAULT_PRIORITY and the
+// name to SACN_DEFAULT_SOURCE_NAME.  The "cid" is a UUID like
+// "5c2a3a47-0a3b-4a5e-9d43-6c1f6c0de0a1"; by default it's made from the machine's hostname and
+// the source name, so it stays the same from one run to the next.
+func ParseSacnUrl(rawurl string) (SacnSettings, error) {
+	settings := SacnSettings{
+		Universe:   SACN_MIN_UNIVERSE,
+		Priority:   SACN_DEFAULT_PRIORITY,
+		SourceName: SACN_DEFAULT_SOURCE_NAME,
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return settings, err
+	}
+	if u.Scheme != SACN_SCHEME || u.Opaque != "" {
+		return settings, fmt.Errorf("%q should look like %s://[host][:port][?universe=1&priority=100&name=...&cid=...&sync=0]", rawurl, SACN_SCHEME)
+	}
+	if u.Hostname() != "" {
+		port := u.Port()
+		if port == "" {
+			port = SACN_PORT
+		}
+		settings.Address = net.JoinHostPort(u.Hostname(), port)
+	} else if u.Port() != "" {
+		return settings, fmt.Errorf("%q: multicast always uses port %v", rawurl, SACN_PORT)
+	}
+	hasCid := false
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "universe":
+			if settings.Universe, err = strconv.Atoi(value); err != nil || settings.Universe < SACN_MIN_UNIVERSE || settings.Universe > SACN_MAX_UNIVERSE {
+				return settings, fmt.Errorf("%q: universe should be between %v and %v", rawurl, SACN_MIN_UNIVERSE, SACN_MAX_UNIVERSE)
+			}
+		case "priority":
+			if settings.Priority, err = strconv.Atoi(value); err != nil || settings.Priority < 0 || settings.Priority > SACN_MAX_PRIORITY {
+				return settings, fmt.Errorf("%q: priority should be between 0 and %v", rawurl, SACN_MAX_PRIORITY)
+			}
+		case "name":
+			if len(value) >= SACN_SOURCE_NAME_SIZE {
+				return settings, fmt.Errorf("%q: name should be shorter than %v bytes", rawurl, SACN_SOURCE_NAME_SIZE)
+			}
+			settings.SourceName = value
+		case "cid":
+			if settings.Cid, err = parseUuid(value); err != nil {
+				return settings, fmt.Errorf("%q: %v", rawurl, err)
+			}
+			hasCid = true
+		case "sync":
+			if settings.SyncUniverse, err = strconv.Atoi(value); err != nil || settings.SyncUniverse < 0 || settings.SyncUniverse > SACN_MAX_UNIVERSE {
+				return settings, fmt.Errorf("%q: sync should be a universe between %v and %v, or 0 for none", rawurl, SACN_MIN_UNIVERSE, SACN_MAX_UNIVERSE)
+			}
+		default:
+			return settings, fmt.Errorf("%q: unknown setting %q", rawurl, key)
+		}
+	}
+	if !hasCid {
+		settings.Cid = defaultSacnCid(settings.SourceName)
+	}
+	return settings, nil
+}
+
+// Parse a UUID like "5c2a3a47-0a3b-4a5e-9d43-6c1f6c0de0a1".
+func parseUuid(s string) ([16]byte, error) {
+	var uuid [16]byte
+	decoded, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(decoded) != len(uuid) {
+		return uuid, fmt.Errorf("cid %q should be a UUID like \"5c2a3a47-0a3b-4a5e-9d43-6c1f6c0de0a1\"", s)
+	}
+	copy(uuid[:], decoded)
+	return uuid, nil
+}
+
+// Make a CID which is the same every time pixelslinger runs on this machine with this source name.
+// It's a name-based (version 5 style) UUID.
+func defaultSacnCid(sourceName string) [16]byte {
+	hostname, _ := os.Hostname()
+	hash := sha1.Sum([]byte("pixelslinger sACN source\x00" + hostname + "\x00" + sourceName))
+	var cid [16]byte
+	copy(cid[:], hash[:])
+	cid[6] = cid[6]&0x0f | 0x50
+	cid[8] = cid[8]&0x3f | 0x80
+	return cid
+}
+
+// Return the multicast address for a universe.
+func sacnMulticastAddress(universe int) string {
+	return net.JoinHostPort(fmt.Sprintf("239.255.%d.%d", universe>>8, universe&0xff), SACN_PORT)
+}
+
+// Write a layer's flags and length, which counts from the start of the layer to the end of the packet.
+func putSacnLength(packet []byte, layerStart int) {
+	binary.BigEndian.PutUint16(packet[layerStart:], SACN_FLAGS|uint16(len(packet)-layerStart))
+}
+
+// Make the root layer shared by all E1.31 packets, followed by zeros up to size.
+func makeSacnPacket(size int, vector uint32, cid [16]byte) []byte {
+	packet := make([]byte, size)
+	binary.BigEndian.PutUint16(packet[0:], 0x0010) // preamble size
+	copy(packet[4:], SACN_ACN_ID)
+	putSacnLength(packet, SACN_ROOT_LAYER_START)
+	binary.BigEndian.PutUint32(packet[18:], vector)
+	copy(packet[22:], cid[:])
+	return packet
+}
+
+// Make an E1.31 data packet with the channel values for one universe.
+func makeSacnDataPacket(settings SacnSettings, sequence byte, universe int, data []byte) []byte {
+	packet := makeSacnPacket(SACN_DATA_HEADER_SIZE+len(data), SACN_VECTOR_ROOT_DATA, settings.Cid)
+
+	// framing layer
+	putSacnLength(packet, SACN_FRAMING_LAYER_START)
+	binary.BigEndian.PutUint32(packet[40:], SACN_VECTOR_FRAMING_DATA)
+	copy(packet[44:44+SACN_SOURCE_NAME_SIZE-1], settings.SourceName)
+	packet[108] = byte(settings.Priority)
+	binary.BigEndian.PutUint16(packet[109:], uint16(settings.SyncUniverse))
+	packet[111] = sequence
+	packet[112] = 0 // options
+	binary.BigEndian.PutUint16(packet[113:], uint16(universe))
+
+	// DMP layer
+	putSacnLength(packet, SACN_DMP_LAYER_START)
+	packet[117] = SACN_VECTOR_DMP_SET
+	packet[118] = SACN_DMP_ADDRESS_TYPE
+	binary.BigEndian.PutUint16(packet[119:], 0)                   // first property address
+	binary.BigEndian.PutUint16(packet[121:], 1)                   // address increment
+	binary.BigEndian.PutUint16(packet[123:], uint16(len(data)+1)) // property count, including the start code
+	packet[125] = 0                                               // DMX start code
+	copy(packet[SACN_DATA_HEADER_SIZE:], data)
+	return packet
+}
+
+// Make an E1.31 universe sync packet.
+func makeSacnSyncPacket(settings SacnSettings, sequence byte) []byte {
+	packet := makeSacnPacket(SACN_SYNC_PACKET_SIZE, SACN_VECTOR_ROOT_EXTENDED, settings.Cid)
+	putSacnLength(packet, SACN_FRAMING_LAYER_START)
+	binary.BigEndian.PutUint32(packet[40:], SACN_VECTOR_FRAMING_SYNC)
+	packet[44] = sequence
+	binary.BigEndian.PutUint16(packet[45:], uint16(settings.SyncUniverse))
+	return packet
+}
+
+// Return the address to send a universe to.
+func (settings SacnSettings) universeAddress(universe int) string {
+	if settings.Address == "" {
+		return sacnMulticastAddress(universe)
+	}
+	return settings.Address
+}
+
+// Return a ByteThread which sends the bytes as sACN, one universe per 170 pixels, starting at
+// settings.Universe.  Each universe goes to its own multicast group if settings.Address is "".
+// If the frames need universes past SACN_MAX_UNIVERSE, exit the whole program with exit status 1.
+func MakeSendToSacnThread(settings SacnSettings, pixelFormats []PixelFormat) ByteThread {
+	description := settings.Address
+	if description == "" {
+		description = "multicast"
+	}
+	checkFrame := func(nPixels int) error {
+		return checkUniverseRange(settings.Universe, nPixels, SACN_MAX_UNIVERSE)
+	}
+	sequence := byte(0)
+	syncSequence := byte(0)
+	return makeUdpOutputThread("SendToSacnThread", description, pixelFormats, checkFrame, func(sender *udpSender, dmxBytes []byte) error {
+		sequence++
+		for uu, data := range splitUniverses(dmxBytes) {
+			universe := settings.Universe + uu
+			if err := sender.send(makeSacnDataPacket(settings, sequence, universe, data), settings.universeAddress(universe)); err != nil {
+				return err
+			}
+		}
+		if settings.SyncUniverse != 0 {
+			syncSequence++
+			return sender.send(makeSacnSyncPacket(settings, syncSequence), settings.universeAddress(settings.SyncUniverse))
+		}
+		return nil
+	})
+}
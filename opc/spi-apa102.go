@@ -0,0 +1,69 @@
+package opc
+
+// APA102
+//   SPI output for LED strips which use the APA102 chipset (sold by Adafruit as DotStar).
+//   Each pixel has a 5-bit global brightness as well as 8 bits per color.  We use it to get
+//   more resolution in the dark end: dim pixels get a low global brightness so that their
+//   colors can use the full 8 bits.
+//   Protocol:
+//     start frame: 4 bytes of 0x00
+//     each pixel: 0xE0 | brightness, then blue, green, red
+//     end frame: one 0xFF byte for every 16 pixels (at least 4) to clock the data all the way
+//       down the strip
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	APA102_START_FRAME_LEN   = 4
+	APA102_MIN_END_FRAME_LEN = 4
+	APA102_MAX_BRIGHTNESS    = 31
+)
+
+type APA102Chipset struct{}
+
+func (APA102Chipset) ColorOrder() string {
+	return "BGR"
+}
+
+func (APA102Chipset) AppendStartFrame(spiBytes []byte, nPixels int) []byte {
+	for ii := 0; ii < APA102_START_FRAME_LEN; ii++ {
+		spiBytes = append(spiBytes, 0)
+	}
+	return spiBytes
+}
+
+func (APA102Chipset) AppendPixel(spiBytes []byte, color [3]float64) []byte {
+	// pick the lowest global brightness which can still show the brightest channel,
+	// then scale the colors up to make up for it
+	brightness := int(math.Ceil(math.Max(color[0], math.Max(color[1], color[2])) * APA102_MAX_BRIGHTNESS))
+	if brightness < 1 {
+		brightness = 1
+	}
+	if brightness > APA102_MAX_BRIGHTNESS {
+		brightness = APA102_MAX_BRIGHTNESS
+	}
+	scale := APA102_MAX_BRIGHTNESS / float64(brightness)
+	return append(spiBytes,
+		0xE0|byte(brightness),
+		linearToSpiByte(color[0]*scale),
+		linearToSpiByte(color[1]*scale),
+		linearToSpiByte(color[2]*scale))
+}
+
+func (APA102Chipset) AppendEndFrame(spiBytes []byte, nPixels int) []byte {
+	endFrameLen := (nPixels + 15) / 16
+	if endFrameLen < APA102_MIN_END_FRAME_LEN {
+		endFrameLen = APA102_MIN_END_FRAME_LEN
+	}
+	for ii := 0; ii < endFrameLen; ii++ {
+		spiBytes = append(spiBytes, 0xFF)
+	}
+	return spiBytes
+}
+
+func (APA102Chipset) LatchTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,49 @@
+package opc
+
+// LPD8806
+//   SPI output for LED strips which use the LPD8806 chipset.
+//   Protocol:
+//     start frame: enough zero bytes to reset the whole strip
+//     each pixel: green, red, blue, 7 bits each with the high bit always on
+//     end frame: a few more black pixels to make the last LEDs latch
+
+import (
+	"time"
+)
+
+type LPD8806Chipset struct{}
+
+func (LPD8806Chipset) ColorOrder() string {
+	return "GRB"
+}
+
+func (LPD8806Chipset) AppendStartFrame(spiBytes []byte, nPixels int) []byte {
+	numZeroes := (nPixels*3+31)/32 + 2
+	for ii := 0; ii < numZeroes*5; ii++ {
+		spiBytes = append(spiBytes, 0)
+	}
+	return spiBytes
+}
+
+func (LPD8806Chipset) AppendPixel(spiBytes []byte, color [3]float64) []byte {
+	for _, v := range color {
+		b := byte(255)
+		if v < 1 {
+			b = byte(v * 256)
+		}
+		// high bit must be always on, remaining seven bits are data
+		spiBytes = append(spiBytes, 128|(b>>1))
+	}
+	return spiBytes
+}
+
+func (LPD8806Chipset) AppendEndFrame(spiBytes []byte, nPixels int) []byte {
+	for ii := 0; ii < 6; ii++ {
+		spiBytes = append(spiBytes, 128)
+	}
+	return spiBytes
+}
+
+func (LPD8806Chipset) LatchTime() time.Duration {
+	return 0
+}
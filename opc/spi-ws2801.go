@@ -0,0 +1,35 @@
+package opc
+
+// WS2801
+//   SPI output for LED strips which use the WS2801 chipset.
+//   Protocol:
+//     each pixel: red, green, blue, 8 bits each
+//     then hold the clock low for at least 500 microseconds so the strip latches the frame
+
+import (
+	"time"
+)
+
+const WS2801_LATCH_TIME = 500 * time.Microsecond
+
+type WS2801Chipset struct{}
+
+func (WS2801Chipset) ColorOrder() string {
+	return "RGB"
+}
+
+func (WS2801Chipset) AppendStartFrame(spiBytes []byte, nPixels int) []byte {
+	return spiBytes
+}
+
+func (WS2801Chipset) AppendPixel(spiBytes []byte, color [3]float64) []byte {
+	return append(spiBytes, linearToSpiByte(color[0]), linearToSpiByte(color[1]), linearToSpiByte(color[2]))
+}
+
+func (WS2801Chipset) AppendEndFrame(spiBytes []byte, nPixels int) []byte {
+	return spiBytes
+}
+
+func (WS2801Chipset) LatchTime() time.Duration {
+	return WS2801_LATCH_TIME
+}
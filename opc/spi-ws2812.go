@@ -0,0 +1,111 @@
+package opc
+
+// WS2812
+//   SPI output for LED strips which use the WS2812 chipset (sold by Adafruit as NeoPixel).
+//   These don't have a clock line, just one data line where each bit is a pulse whose width
+//   says whether it's a 0 or a 1.  We fake that on the SPI data line by expanding each data bit
+//   into several SPI bits: a few 1s then 0s for the rest of the bit time.  At 2.4 MHz each data
+//   bit becomes 3 SPI bits, 100 for a 0 and 110 for a 1.
+//   The SPI device has to be set to the same clock rate as SpiHz; this doesn't change it.
+//   The strip shows the frame once the data line has been low for a while, so the frame ends
+//   with enough zero bytes for that.
+//   The frame is written in chunks of SPI_CHUNK_SIZE, and a pause between chunks in the middle
+//   of a pulse can garble the rest of the frame, so long strips may need a bigger chunk size.
+//   Protocol:
+//     each pixel: green, red, blue, 8 bits each, most significant bit first
+//     end frame: at least WS2812_RESET_TIME of low
+
+import (
+	"math"
+	"time"
+)
+
+// Timing of each data bit
+const (
+	WS2812_BIT_TIME   = 1250 * time.Nanosecond // whole bit
+	WS2812_T0H        = 400 * time.Nanosecond  // high part of a 0
+	WS2812_T1H        = 800 * time.Nanosecond  // high part of a 1
+	WS2812_RESET_TIME = 300 * time.Microsecond
+)
+
+const WS2812_DEFAULT_SPI_HZ = 2400000
+
+type WS2812Chipset struct {
+	SpiHz int // SPI clock rate
+}
+
+// Return the number of SPI bits in a whole data bit, and how many of them are high for a 0
+// and for a 1.
+func (chipset WS2812Chipset) bitTiming() (bitLen, zeroLen, oneLen int) {
+	spiBits := func(d time.Duration) int {
+		return int(math.Floor(d.Seconds()*float64(chipset.SpiHz) + 0.5))
+	}
+	bitLen = spiBits(WS2812_BIT_TIME)
+	if bitLen < 2 {
+		bitLen = 2
+	}
+	zeroLen = spiBits(WS2812_T0H)
+	if zeroLen < 1 {
+		zeroLen = 1
+	}
+	oneLen = spiBits(WS2812_T1H)
+	if oneLen <= zeroLen {
+		oneLen = zeroLen + 1
+	}
+	if oneLen >= bitLen {
+		oneLen = bitLen - 1
+		if zeroLen >= oneLen {
+			zeroLen = oneLen - 1
+		}
+	}
+	return
+}
+
+func (WS2812Chipset) ColorOrder() string {
+	return "GRB"
+}
+
+func (WS2812Chipset) AppendStartFrame(spiBytes []byte, nPixels int) []byte {
+	return spiBytes
+}
+
+// Each pixel is 24 data bits, which always comes out to a whole number of SPI bytes.
+func (chipset WS2812Chipset) AppendPixel(spiBytes []byte, color [3]float64) []byte {
+	bitLen, zeroLen, oneLen := chipset.bitTiming()
+	var current byte
+	nBits := 0
+	for _, v := range color {
+		b := linearToSpiByte(v)
+		for bit := 7; bit >= 0; bit-- {
+			highLen := zeroLen
+			if b&(1<<uint(bit)) != 0 {
+				highLen = oneLen
+			}
+			for ii := 0; ii < bitLen; ii++ {
+				current <<= 1
+				if ii < highLen {
+					current |= 1
+				}
+				nBits++
+				if nBits == 8 {
+					spiBytes = append(spiBytes, current)
+					current = 0
+					nBits = 0
+				}
+			}
+		}
+	}
+	return spiBytes
+}
+
+func (chipset WS2812Chipset) AppendEndFrame(spiBytes []byte, nPixels int) []byte {
+	resetLen := int(math.Ceil(WS2812_RESET_TIME.Seconds() * float64(chipset.SpiHz) / 8))
+	for ii := 0; ii < resetLen; ii++ {
+		spiBytes = append(spiBytes, 0)
+	}
+	return spiBytes
+}
+
+func (WS2812Chipset) LatchTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,132 @@
+package opc
+
+// SPI output
+//   One ByteThread which drives LED strips on the SPI bus, shared by all the chipsets we support.
+//   It takes care of gamma, pixel formats (see pixel-format.go) and writing to the SPI device;
+//   each chipset only has to say how to turn pixels into bytes.  See spi-*.go for the chipsets.
+
+import (
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"os"
+	"time"
+)
+
+// The parts of a LED chipset's SPI protocol.
+type SpiChipset interface {
+	// The order the chipset expects colors in, like "GRB".
+	ColorOrder() string
+	// Append whatever comes before the first pixel of a frame of nPixels.
+	AppendStartFrame(spiBytes []byte, nPixels int) []byte
+	// Append one pixel.  Its colors are linear light output from 0 to 1, already in the
+	// chipset's color order.
+	AppendPixel(spiBytes []byte, color [3]float64) []byte
+	// Append whatever comes after the last pixel of a frame of nPixels.
+	AppendEndFrame(spiBytes []byte, nPixels int) []byte
+	// How long the data line has to stay quiet after a frame before the strip shows it.
+	LatchTime() time.Duration
+}
+
+// The chipsets which can be chosen by name, like "--dest apa102".
+var SPI_CHIPSETS = map[string]SpiChipset{
+	"apa102":  APA102Chipset{},
+	"lpd8806": LPD8806Chipset{},
+	"ws2801":  WS2801Chipset{},
+	"ws2812":  WS2812Chipset{SpiHz: WS2812_DEFAULT_SPI_HZ},
+}
+
+// Write spiBytes to the SPI file in chunks of SPI_CHUNK_SIZE.
+// Panic if the write fails.
+func writeSpiBytes(spiFile *os.File, spiBytes []byte) {
+	for ii := 0; ii < len(spiBytes); ii += SPI_CHUNK_SIZE {
+		endIndex := ii + SPI_CHUNK_SIZE
+		if endIndex > len(spiBytes) {
+			endIndex = len(spiBytes)
+		}
+		if _, err := spiFile.Write(spiBytes[ii:endIndex]); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Prepared settings for encoding frames for one chipset.
+type spiEncoder struct {
+	chipset   SpiChipset
+	formatter *pixelFormatter
+}
+
+// Prepare to encode frames for the chipset.  pixelFormats has the format of each pixel;
+// pixels past the end of it use DEFAULT_PIXEL_FORMAT.
+// Return an error if any color order is invalid.
+func newSpiEncoder(chipset SpiChipset, pixelFormats []PixelFormat) (*spiEncoder, error) {
+	formatter, err := newPixelFormatter(chipset.ColorOrder(), pixelFormats)
+	if err != nil {
+		return nil, err
+	}
+	return &spiEncoder{chipset: chipset, formatter: formatter}, nil
+}
+
+// Append the SPI bytes for a frame to spiBytes and return the result.
+func (encoder *spiEncoder) encode(spiBytes []byte, bytes []byte) []byte {
+	nPixels := len(bytes) / 3
+	spiBytes = encoder.chipset.AppendStartFrame(spiBytes, nPixels)
+	for ii := 0; ii < nPixels; ii++ {
+		rgb := [3]float64{
+			encoder.formatter.gamma_lookup[bytes[ii*3+0]],
+			encoder.formatter.gamma_lookup[bytes[ii*3+1]],
+			encoder.formatter.gamma_lookup[bytes[ii*3+2]],
+		}
+		spiBytes = encoder.chipset.AppendPixel(spiBytes, encoder.formatter.format(ii, rgb))
+	}
+	return encoder.chipset.AppendEndFrame(spiBytes, nPixels)
+}
+
+// Return a ByteThread which writes bytes to SPI via the given filename (such as "/dev/spidev1.0"),
+// formatted for the chipset.  pixelFormats has the format of each pixel; pixels past the end of
+// it use DEFAULT_PIXEL_FORMAT.
+// If the SPI device can't be opened or a color order is invalid, exit the whole program with
+// exit status 1.
+func MakeSendToSpiThread(spiFn string, chipset SpiChipset, pixelFormats []PixelFormat) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		fmt.Printf("[opc.SendToSpiThread] starting up: %T on %s\n", chipset, spiFn)
+
+		encoder, err := newSpiEncoder(chipset, pixelFormats)
+		if err != nil {
+			fmt.Println("[opc.SendToSpiThread] Error:", err)
+			os.Exit(1)
+		}
+
+		// open output file and keep the file descriptor around
+		spiFile, err := os.Create(spiFn)
+		if err != nil {
+			fmt.Println("[opc.SendToSpiThread] Error opening SPI file:")
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// close spiFile on exit and check for its returned error
+		defer func() {
+			if err := spiFile.Close(); err != nil {
+				panic(err)
+			}
+		}()
+
+		spiBytes := make([]byte, 0)
+		for bytes := range bytesIn {
+			spiBytes = encoder.encode(spiBytes[:0], bytes)
+			writeSpiBytes(spiFile, spiBytes)
+			time.Sleep(chipset.LatchTime())
+			bytesOut <- bytes
+		}
+	}
+}
+
+// Round linear light output from 0 to 1 to the nearest byte.
+func linearToSpiByte(v float64) byte {
+	if v >= 1 {
+		return 255
+	}
+	if v <= 0 {
+		return 0
+	}
+	return byte(v*255 + 0.5)
+}
@@ -0,0 +1,94 @@
+package opc
+
+// UDP output
+//   The part the Art-Net, sACN and DDP destinations have in common.  Each frame is gamma
+//   corrected and adjusted according to the layout's pixel formats (see pixel-format.go), like
+//   it is for OPC, and then the protocol turns it into UDP packets.
+//   There's no connection with UDP, so the only thing to go wrong is usually an address which
+//   doesn't resolve.  A frame which can't be sent is dropped, and the next frame starts over
+//   with a new socket.
+
+import (
+	"fmt"
+	"github.com/longears/pixelslinger/midi"
+	"net"
+	"os"
+)
+
+// Sends UDP packets from one socket, which is opened when the first packet goes out.
+type udpSender struct {
+	conn  net.PacketConn
+	addrs map[string]net.Addr // resolved addresses, by host:port
+}
+
+// Send a packet to the host:port, resolving it the first time.
+func (sender *udpSender) send(packet []byte, address string) error {
+	if sender.conn == nil {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return err
+		}
+		sender.conn = conn
+		sender.addrs = make(map[string]net.Addr)
+	}
+	udpAddr, ok := sender.addrs[address]
+	if !ok {
+		resolved, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return err
+		}
+		udpAddr = resolved
+		sender.addrs[address] = udpAddr
+	}
+	_, err := sender.conn.WriteTo(packet, udpAddr)
+	return err
+}
+
+// Close the socket, if it's open.  The next packet opens a new one.
+func (sender *udpSender) close() {
+	if sender.conn != nil {
+		sender.conn.Close()
+		sender.conn = nil
+	}
+}
+
+// Return a ByteThread which formats each frame and hands it to sendFrame to send.
+// name is the thread's name for log messages, and description says where it's sending to.
+// checkFrame, if it isn't nil, is called with the number of pixels whenever that changes.
+// If a color order is invalid or checkFrame returns an error, exit the whole program with exit
+// status 1.
+func makeUdpOutputThread(name string, description string, pixelFormats []PixelFormat, checkFrame func(nPixels int) error, sendFrame func(sender *udpSender, bytes []byte) error) ByteThread {
+	return func(bytesIn chan []byte, bytesOut chan []byte, midiState *midi.MidiState) {
+		fmt.Printf("[opc.%s] starting up: %s\n", name, description)
+
+		formatter, err := newPixelFormatter("RGB", pixelFormats)
+		if err != nil {
+			fmt.Printf("[opc.%s] Error: %v\n", name, err)
+			os.Exit(1)
+		}
+
+		sender := &udpSender{}
+		defer sender.close()
+
+		formattedBytes := make([]byte, 0)
+		for bytes := range bytesIn {
+			if len(formattedBytes) != len(bytes) {
+				if checkFrame != nil {
+					if err := checkFrame(len(bytes) / 3); err != nil {
+						fmt.Printf("[opc.%s] Error: %v\n", name, err)
+						os.Exit(1)
+					}
+				}
+				formattedBytes = make([]byte, len(bytes))
+			}
+			formatter.formatBytes(formattedBytes, bytes)
+
+			if err := sendFrame(sender, formattedBytes); err != nil {
+				// net error -- start over with a new socket next time
+				fmt.Printf("[opc.%s] %v\n", name, err)
+				sender.close()
+			}
+			bytesOut <- bytes
+		}
+	}
+}
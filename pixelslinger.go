@@ -1,8 +1,5 @@
 package main
 
-// TODO: figure out how to handle varying numbers of pixels
-// when we're getting pixels via our OPC server source
-
 import (
 	"fmt"
 	"github.com/droundy/goopt"
@@ -14,6 +11,7 @@ import (
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,7 +23,12 @@ const SPI_MAGIC_WORD = "spi"
 const PRINT_MAGIC_WORD = "print"
 const DEVNULL_MAGIC_WORD = "/dev/null"
 const LOCALHOST = "localhost"
+const UDP_PREFIX = "udp://"
+const NO_EFFECTS_MAGIC_WORD = "none"
 const SPI_FN = "/dev/spidev1.0"
+const SPI_DEVICE_PREFIX = "/dev/spidev"
+const RECORD_PREFIX = "record:"
+const PLAY_PREFIX = "play:"
 
 func init() {
 	runtime.GOMAXPROCS(2)
@@ -33,17 +36,28 @@ func init() {
 
 // these are pointers to the actual values from the command line parser
 var LAYOUT_FN = goopt.String([]string{"-l", "--layout"}, "...", "layout file (required)")
-var SOURCE = goopt.String([]string{"-s", "--source"}, "spatial-stripes", "pixel source (either a pattern name or "+LOCALHOST+"[:port])")
-var DEST = goopt.String([]string{"-d", "--dest"}, "localhost", "destination (one of "+PRINT_MAGIC_WORD+", "+SPI_MAGIC_WORD+", "+DEVNULL_MAGIC_WORD+", or hostname[:port])")
+var SOURCE = goopt.String([]string{"-s", "--source"}, "spatial-stripes", "pixel source (either a pattern name, "+PLAY_PREFIX+"file, "+LOCALHOST+"[:port], "+UDP_PREFIX+"[host][:port], "+opc.ARTNET_SCHEME+"://[ip][:port][?...], or "+opc.SACN_SCHEME+"://[ip][:port][?...])")
+var DEST = goopt.String([]string{"-d", "--dest"}, "localhost", "comma-separated list of destinations (each one of "+PRINT_MAGIC_WORD+", "+SPI_MAGIC_WORD+", "+SPI_DEVICE_PREFIX+"*, chipset[:"+SPI_DEVICE_PREFIX+"*], "+DEVNULL_MAGIC_WORD+", "+RECORD_PREFIX+"file, hostname[:port], "+opc.ARTNET_SCHEME+"://host[:port][?...], "+opc.SACN_SCHEME+"://[host][:port][?...], or "+opc.DDP_SCHEME+"://host[:port])")
+var EFFECTS = goopt.String([]string{"-e", "--effects"}, "fader", "comma-separated list of effects to apply in order, or "+NO_EFFECTS_MAGIC_WORD+" (the destinations always gamma correct, so gamma does nothing)")
+var OUTPUTS_FN = goopt.String([]string{"--outputs"}, "", "output map file which splits the layout between several destinations (overrides --dest)")
 var FPS = goopt.Int([]string{"-f", "--fps"}, 40, "max frames per second")
+var FIXED_STEP = goopt.Flag([]string{"--fixed-step"}, []string{}, "move the patterns' clock on by exactly 1/fps seconds each frame instead of following the wall clock", "")
 var SECONDS = goopt.Int([]string{"-n", "--seconds"}, 0, "quit after this many seconds")
 var ONCE = goopt.Flag([]string{"-o", "--once"}, []string{}, "quit after one frame", "")
+var INPUT_TIMEOUT = goopt.Int([]string{"--input-timeout"}, 5, "when running an OPC, Art-Net or sACN server, seconds without input before --on-timeout kicks in (0 for never)")
+var ON_TIMEOUT = goopt.Alternatives([]string{"--on-timeout"}, []string{opc.HOLD_LAST_FRAME, opc.FADE_TO_BLACK}, "what to do when network input times out")
+var RESIZE = goopt.Alternatives([]string{"--resize"}, []string{opc.RESIZE_ZERO_PAD, opc.RESIZE_TRUNCATE, opc.RESIZE_REPEAT, opc.RESIZE_RESCALE}, "when running an OPC server or playing a recording, how to fit frames with the wrong number of pixels to the layout")
+var PLAYBACK_TIMING = goopt.Alternatives([]string{"--playback-timing"}, []string{opc.PLAYBACK_TIMING_RECORDED, opc.PLAYBACK_TIMING_FPS}, "when playing a recording, show frames at the times they were recorded or one per frame")
+var SPEED = goopt.String([]string{"--speed"}, "1", "when playing a recording, how many times faster than real time")
+var SEEK = goopt.String([]string{"--seek"}, "0", "when playing a recording, seconds in to start from")
+var LOOP = goopt.Flag([]string{"--loop"}, []string{}, "when playing a recording, go back to --seek at the end", "")
+var FADECANDY = goopt.Flag([]string{"--fadecandy"}, []string{}, "when sending OPC, configure the destination as a FadeCandy server", "")
 
 // Parse the command line flags.  If invalid, show help and quit.
 // Add default ports if needed.
 // Read the layout file.
-// Return the number of pixels in the layout, the source and dest thread methods.
-func parseFlags() (nPixels int, sourceThread, effectThread, destThread opc.ByteThread) {
+// Return the number of pixels in the layout, the source, effect, and dest thread methods.
+func parseFlags() (nPixels int, sourceThread opc.ByteThread, effectThreads []opc.ByteThread, destThread opc.ByteThread) {
 
 	// get sorted pattern names
 	patternNames := make([]string, len(opc.PATTERN_REGISTRY))
@@ -54,10 +68,32 @@ func parseFlags() (nPixels int, sourceThread, effectThread, destThread opc.ByteT
 	}
 	sort.Strings(patternNames)
 
+	// get sorted effect names
+	effectNames := make([]string, 0, len(opc.EFFECT_REGISTRY))
+	for k, _ := range opc.EFFECT_REGISTRY {
+		effectNames = append(effectNames, k)
+	}
+	sort.Strings(effectNames)
+
+	// get sorted SPI chipset names
+	chipsetNames := make([]string, 0, len(opc.SPI_CHIPSETS))
+	for k, _ := range opc.SPI_CHIPSETS {
+		chipsetNames = append(chipsetNames, k)
+	}
+	sort.Strings(chipsetNames)
+
 	goopt.Summary = "Available source patterns:\n"
 	for _, patternName := range patternNames {
 		goopt.Summary += "          " + patternName + "\n"
 	}
+	goopt.Summary += "\nAvailable effects:\n"
+	for _, effectName := range effectNames {
+		goopt.Summary += "          " + effectName + "\n"
+	}
+	goopt.Summary += "\nAvailable SPI chipsets:\n"
+	for _, chipsetName := range chipsetNames {
+		goopt.Summary += "          " + chipsetName + "\n"
+	}
 	goopt.Parse(nil)
 
 	// layout is required
@@ -67,22 +103,38 @@ func parseFlags() (nPixels int, sourceThread, effectThread, destThread opc.ByteT
 		os.Exit(1)
 	}
 
-	// read locations
-	locations := opc.ReadLocations(*LAYOUT_FN)
-	nPixels = len(locations) / 3
+	// read layout and locations
+	layout, err := opc.ReadLayout(*LAYOUT_FN)
+	if err != nil {
+		fmt.Println("Error:", err)
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
+	}
+	locations := layout.Locations()
+	nPixels = len(layout.Pixels)
 
 	// choose source thread method
-	if strings.Contains(*SOURCE, LOCALHOST) {
-		// source is localhost, so we will start an OPC server.
-		// add default port if needed
-		if !strings.Contains(*SOURCE, ":") {
-			*SOURCE += ":7890"
-		}
-		sourceThread = opc.MakeOpcServerThread(*SOURCE)
-	} else if (*SOURCE)[0] == ':' {
-		// source is ":4908"
-		*SOURCE = "localhost" + *SOURCE
-		sourceThread = opc.MakeOpcServerThread(*SOURCE)
+	if strings.HasPrefix(*SOURCE, opc.ARTNET_SCHEME+"://") || strings.HasPrefix(*SOURCE, opc.SACN_SCHEME+"://") {
+		// source is "artnet://..." or "sacn://...", so we will listen for DMX from a lighting console.
+		dmxSettings, err := opc.ParseDmxSourceUrl(*SOURCE)
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		sourceThread = opc.MakeDmxServerThread(dmxSettings, readUniverseMap(dmxSettings.Scheme, nPixels), opc.OpcSourceSettings{
+			InputTimeout: float64(*INPUT_TIMEOUT),
+			OnTimeout:    *ON_TIMEOUT,
+		})
+	} else if strings.HasPrefix(*SOURCE, PLAY_PREFIX) {
+		// source is "play:show.rec", so we will play back a recording.
+		sourceThread = opc.MakePlaybackThread(strings.TrimPrefix(*SOURCE, PLAY_PREFIX), layout, playbackSettings())
+	} else if strings.HasPrefix(*SOURCE, UDP_PREFIX) {
+		// source is "udp://:7890", so we will start an OPC server listening for datagrams.
+		sourceThread = opc.MakeOpcUdpServerThread(serverListenAddress(strings.TrimPrefix(*SOURCE, UDP_PREFIX)), opcSourceSettings(nPixels))
+	} else if strings.Contains(*SOURCE, LOCALHOST) || (*SOURCE)[0] == ':' {
+		// source is "localhost", "localhost:4908", or ":4908", so we will start an OPC server.
+		sourceThread = opc.MakeOpcServerThread(serverListenAddress(*SOURCE), opcSourceSettings(nPixels))
 	} else {
 		// source is a pattern name
 		sourceThreadMaker, ok := opc.PATTERN_REGISTRY[*SOURCE]
@@ -94,33 +146,197 @@ func parseFlags() (nPixels int, sourceThread, effectThread, destThread opc.ByteT
 		sourceThread = sourceThreadMaker(locations)
 	}
 
-	// choose effect thread method
-	effectThread = opc.MakeEffectFader(locations)
+	// choose effect thread methods, in order
+	if *EFFECTS != NO_EFFECTS_MAGIC_WORD {
+		for _, effectName := range strings.Split(*EFFECTS, ",") {
+			effectName = strings.TrimSpace(effectName)
+			effectThreadMaker, ok := opc.EFFECT_REGISTRY[effectName]
+			if !ok {
+				fmt.Printf("Error: unknown effect \"%s\"\n", effectName)
+				fmt.Println("--------------------------------------------------------------------------------/")
+				os.Exit(1)
+			}
+			effectThreads = append(effectThreads, effectThreadMaker(layout))
+		}
+	}
 
-	// choose dest thread method
-	switch *DEST {
-	case DEVNULL_MAGIC_WORD:
-		destThread = opc.MakeSendToDevNullThread()
-	case PRINT_MAGIC_WORD:
-		destThread = opc.MakeSendToScreenThread()
-	case SPI_MAGIC_WORD:
-		destThread = opc.MakeSendToLPD8806Thread(SPI_FN)
-	default:
-		// add default port if needed
-		if !strings.Contains(*DEST, ":") {
-			*DEST += ":7890"
+	// choose dest thread methods.  if there's more than one, send to all of them at once
+	destThreads := make([]opc.ByteThread, 0)
+	if *OUTPUTS_FN != "" {
+		// each output only gets its own part of the layout
+		outputMap, err := opc.ReadOutputMap(*OUTPUTS_FN, nPixels)
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		for _, output := range outputMap {
+			outputLayout := layout.Subset(output.PixelRange, output.Reverse)
+			destThreads = append(destThreads, opc.MakeOutputThread(output, makeDestThread(output.Dest, outputLayout, output.Channel)))
 		}
-		destThread = opc.MakeSendToOpcThread(*DEST)
+	} else {
+		for _, dest := range strings.Split(*DEST, ",") {
+			destThreads = append(destThreads, makeDestThread(strings.TrimSpace(dest), layout, 0))
+		}
+	}
+	if len(destThreads) == 1 {
+		destThread = destThreads[0]
+	} else {
+		destThread = opc.MakeFanOutThread(destThreads...)
+	}
+
+	return // returns nPixels, sourceThread, effectThreads, destThread
+}
+
+// Return the ByteThread for one --dest value, which will send the pixels of the given layout.
+// OPC destinations send on the given channel.
+func makeDestThread(dest string, layout *opc.Layout, channel byte) opc.ByteThread {
+	switch {
+	case dest == DEVNULL_MAGIC_WORD:
+		return opc.MakeSendToDevNullThread()
+	case dest == PRINT_MAGIC_WORD:
+		return opc.MakeSendToScreenThread()
+	case strings.HasPrefix(dest, RECORD_PREFIX):
+		return opc.MakeSendToRecordingThread(strings.TrimPrefix(dest, RECORD_PREFIX), layout)
+	case dest == SPI_MAGIC_WORD:
+		return opc.MakeSendToSpiThread(SPI_FN, opc.LPD8806Chipset{}, layout.PixelFormats())
+	case strings.HasPrefix(dest, SPI_DEVICE_PREFIX):
+		return opc.MakeSendToSpiThread(dest, opc.LPD8806Chipset{}, layout.PixelFormats())
+	case strings.HasPrefix(dest, opc.ARTNET_SCHEME+"://"):
+		settings, err := opc.ParseArtnetUrl(dest)
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		return opc.MakeSendToArtnetThread(settings, layout.PixelFormats())
+	case strings.HasPrefix(dest, opc.SACN_SCHEME+"://"):
+		settings, err := opc.ParseSacnUrl(dest)
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		return opc.MakeSendToSacnThread(settings, layout.PixelFormats())
+	case strings.HasPrefix(dest, opc.DDP_SCHEME+"://"):
+		ipPort, err := opc.ParseDDPUrl(dest)
+		if err != nil {
+			fmt.Println("Error:", err)
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		return opc.MakeSendToDDPThread(ipPort, layout.PixelFormats())
+	}
+	// a chipset name, optionally followed by the SPI device
+	chipsetName, spiFn := dest, SPI_FN
+	if colon := strings.Index(dest, ":"); colon >= 0 {
+		chipsetName, spiFn = dest[:colon], dest[colon+1:]
 	}
+	if chipset, ok := opc.SPI_CHIPSETS[chipsetName]; ok {
+		return opc.MakeSendToSpiThread(spiFn, chipset, layout.PixelFormats())
+	}
+	// add default port if needed
+	if !strings.Contains(dest, ":") {
+		dest += ":7890"
+	}
+	if *FADECANDY {
+		// we already gamma-correct the pixels we send, so tell the FadeCandy server not to
+		return opc.MakeSendToOpcChannelThread(dest, channel, layout.PixelFormats(), opc.MakeFadecandyColorCorrectionMessage(opc.FadecandyColorCorrection{
+			Gamma:      1,
+			Whitepoint: [3]float64{1, 1, 1},
+		}))
+	}
+	return opc.MakeSendToOpcChannelThread(dest, channel, layout.PixelFormats())
+}
+
+// Convert a --source value like "localhost", "localhost:4908" or ":4908" into an address
+// for the OPC server to listen on, adding the default port if needed.
+// "localhost" here just means "run a server on this machine", so we listen on all interfaces
+// so that OPC clients on other machines can reach us too.
+func serverListenAddress(source string) string {
+	ipPort := strings.TrimPrefix(source, LOCALHOST)
+	if !strings.Contains(ipPort, ":") {
+		ipPort += ":7890"
+	}
+	return ipPort
+}
 
-	return // returns nPixels, sourceThread, destThread
+// Gather the settings for an OPC server source from the command line flags.
+func opcSourceSettings(nPixels int) opc.OpcSourceSettings {
+	return opc.OpcSourceSettings{
+		ChannelMap:   readChannelMap(nPixels),
+		InputTimeout: float64(*INPUT_TIMEOUT),
+		OnTimeout:    *ON_TIMEOUT,
+		ResizePolicy: *RESIZE,
+	}
+}
+
+// Gather the settings for a playback source from the command line flags.
+// If they're invalid, show the error and quit.
+func playbackSettings() opc.PlaybackSettings {
+	speed, err := strconv.ParseFloat(*SPEED, 64)
+	if err != nil || speed <= 0 {
+		fmt.Printf("Error: --speed should be a number greater than 0, not \"%s\"\n", *SPEED)
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
+	}
+	seek, err := strconv.ParseFloat(*SEEK, 64)
+	if err != nil || seek < 0 {
+		fmt.Printf("Error: --seek should be a number of seconds, not \"%s\"\n", *SEEK)
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
+	}
+	return opc.PlaybackSettings{
+		Timing:       *PLAYBACK_TIMING,
+		Speed:        speed,
+		Seek:         seek,
+		Loop:         *LOOP,
+		ResizePolicy: *RESIZE,
+	}
+}
+
+// Read the OPC channel map which lives alongside the layout file, if there is one.
+// For "layouts/foo.json" it's "layouts/foo.channels.json".
+// Return nil if there's no such file.  If it exists but is invalid, show the error and quit.
+func readChannelMap(nPixels int) opc.ChannelMap {
+	channelMapFn := strings.TrimSuffix(*LAYOUT_FN, ".json") + ".channels.json"
+	if _, err := os.Stat(channelMapFn); err != nil {
+		return nil
+	}
+	channelMap, err := opc.ReadChannelMap(channelMapFn, nPixels)
+	if err != nil {
+		fmt.Println("Error:", err)
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
+	}
+	return channelMap
+}
+
+// Read the DMX universe map which lives alongside the layout file, if there is one.
+// For "layouts/foo.json" it's "layouts/foo.universes.json".
+// scheme is the protocol the universes arrive over, which decides which universes are allowed.
+// Return nil if there's no such file.  If it exists but is invalid, show the error and quit.
+func readUniverseMap(scheme string, nPixels int) opc.UniverseMap {
+	universeMapFn := strings.TrimSuffix(*LAYOUT_FN, ".json") + ".universes.json"
+	if _, err := os.Stat(universeMapFn); err != nil {
+		return nil
+	}
+	universeMap, err := opc.ReadUniverseMap(universeMapFn, scheme, nPixels)
+	if err != nil {
+		fmt.Println("Error:", err)
+		fmt.Println("--------------------------------------------------------------------------------/")
+		os.Exit(1)
+	}
+	return universeMap
 }
 
 // Launch the sourceThread and destThread methods and coordinate the transfer of bytes from one to the other.
+// Filled bytes pass through each of the effectThreads in order on their way from the source.
 // Run until timeToRun seconds have passed and return.  If timeToRun is 0, run forever.
 // Turn on the CPU profiler if timeToRun seconds > 0.
 // Limit the framerate to a max of fps unless fps is 0.
-func mainLoop(nPixels int, sourceThread, effectThread, destThread opc.ByteThread, fps float64, timeToRun float64) {
+// Each frame gets its time from the clock, which is handed to the patterns with opc.SetFrameContext.
+func mainLoop(nPixels int, sourceThread opc.ByteThread, effectThreads []opc.ByteThread, destThread opc.ByteThread, clock *opc.FrameClock, fps float64, timeToRun float64) {
 	if timeToRun > 0 {
 		fmt.Printf("[mainLoop] Running for %f seconds with profiling turned on, pixels and network\n", timeToRun)
 		defer profile.Start(profile.CPUProfile).Stop()
@@ -133,7 +349,6 @@ func mainLoop(nPixels int, sourceThread, effectThread, destThread opc.ByteThread
 	sendingSlice := make([]byte, nPixels*3)
 
 	bytesToFillChan := make(chan []byte, 0)
-	toEffectChan := make(chan []byte, 0)
 	bytesFilledChan := make(chan []byte, 0)
 	bytesToSendChan := make(chan []byte, 0)
 	bytesSentChan := make(chan []byte, 0)
@@ -148,8 +363,21 @@ func mainLoop(nPixels int, sourceThread, effectThread, destThread opc.ByteThread
 	}
 
 	// launch the threads
+	// each effect reads from the channel the thread before it writes to
+	// and the last one writes to bytesFilledChan
+	toEffectChan := bytesFilledChan
+	if len(effectThreads) > 0 {
+		toEffectChan = make(chan []byte, 0)
+	}
 	go sourceThread(bytesToFillChan, toEffectChan, &midiState)
-	go effectThread(toEffectChan, bytesFilledChan, &midiState)
+	for ii, effectThread := range effectThreads {
+		fromEffectChan := bytesFilledChan
+		if ii < len(effectThreads)-1 {
+			fromEffectChan = make(chan []byte, 0)
+		}
+		go effectThread(toEffectChan, fromEffectChan, &midiState)
+		toEffectChan = fromEffectChan
+	}
 	go destThread(bytesToSendChan, bytesSentChan, &midiState)
 
 	// main loop
@@ -201,6 +429,8 @@ func mainLoop(nPixels int, sourceThread, effectThread, destThread opc.ByteThread
 		// start the threads filling and sending slices in parallel.
 		// if this is the first time through the loop we have to skip
 		//  the sending stage or we'll send out a whole bunch of zeros.
+		// the frame context has to be set before the filling starts.
+		opc.SetFrameContext(clock.Tick())
 		bytesToFillChan <- fillingSlice
 		if !firstIteration {
 			bytesToSendChan <- sendingSlice
@@ -235,6 +465,16 @@ func main() {
 	fmt.Println("--------------------------------------------------------------------------------\\")
 	defer fmt.Println("--------------------------------------------------------------------------------/")
 
-	nPixels, sourceThread, effectThread, destThread := parseFlags()
-	mainLoop(nPixels, sourceThread, effectThread, destThread, float64(*FPS), float64(*SECONDS))
+	nPixels, sourceThread, effectThreads, destThread := parseFlags()
+
+	clock := opc.MakeRealTimeClock()
+	if *FIXED_STEP {
+		if *FPS <= 0 {
+			fmt.Println("Error: --fixed-step needs --fps to be more than 0")
+			fmt.Println("--------------------------------------------------------------------------------/")
+			os.Exit(1)
+		}
+		clock = opc.MakeFixedStepClock(0, float64(*FPS))
+	}
+	mainLoop(nPixels, sourceThread, effectThreads, destThread, clock, float64(*FPS), float64(*SECONDS))
 }
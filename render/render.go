@@ -0,0 +1,81 @@
+/*
+Command render runs a pattern without any LEDs and saves a picture of it, for previews.
+
+It writes a PNG timeline, with one column per pixel and one row per frame.  The pattern runs on a
+simulated clock, so the picture comes out the same however fast the computer is:
+
+	render --layout layouts/freespace.json --source fire --frames 200 --timeline fire.png
+*/
+package main
+
+import (
+	"fmt"
+	"github.com/droundy/goopt"
+	"github.com/longears/pixelslinger/opc"
+	"image/png"
+	"os"
+	"strconv"
+)
+
+// these are pointers to the actual values from the command line parser
+var LAYOUT_FN = goopt.String([]string{"-l", "--layout"}, "...", "layout file (required)")
+var SOURCE = goopt.String([]string{"-s", "--source"}, "spatial-stripes", "pattern name")
+var FRAMES = goopt.Int([]string{"-n", "--frames"}, 100, "number of frames to render")
+var FPS = goopt.Int([]string{"-f", "--fps"}, 40, "frames per second of simulated time")
+var START = goopt.String([]string{"--start"}, "0", "simulated time of the first frame, in seconds")
+var TIMELINE_FN = goopt.String([]string{"--timeline"}, "...", "PNG file to write the timeline to (required)")
+var SCALE = goopt.Int([]string{"--scale"}, 2, "width and height of each pixel in the timeline")
+
+func quit(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	fmt.Fprintln(os.Stderr, goopt.Usage())
+	os.Exit(1)
+}
+
+// Create the file fn and pass it to write, quitting if anything goes wrong.
+func writeFile(fn string, write func(file *os.File) error) {
+	file, err := os.Create(fn)
+	if err != nil {
+		quit(fmt.Sprintf("Error: %v", err))
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		quit(fmt.Sprintf("Error: %s: %v", fn, err))
+	}
+	if err := file.Close(); err != nil {
+		quit(fmt.Sprintf("Error: %s: %v", fn, err))
+	}
+	fmt.Fprintln(os.Stderr, "[render] wrote", fn)
+}
+
+func main() {
+	goopt.Parse(nil)
+
+	if *LAYOUT_FN == "..." {
+		quit("Error: --layout is required")
+	}
+	if *TIMELINE_FN == "..." {
+		quit("Error: --timeline is required")
+	}
+	if *FRAMES < 1 || *FPS < 1 || *SCALE < 1 {
+		quit("Error: --frames, --fps and --scale must be at least 1")
+	}
+	startTime, err := strconv.ParseFloat(*START, 64)
+	if err != nil {
+		quit(fmt.Sprintf("Error: bad value for --start: %s", *START))
+	}
+	layout, err := opc.ReadLayout(*LAYOUT_FN)
+	if err != nil {
+		quit(fmt.Sprintf("Error: %v", err))
+	}
+	sourceThreadMaker, ok := opc.PATTERN_REGISTRY[*SOURCE]
+	if !ok {
+		quit(fmt.Sprintf("Error: unknown pattern \"%s\"", *SOURCE))
+	}
+
+	frames := opc.RenderFrames(sourceThreadMaker(layout.Locations()), len(layout.Pixels), *FRAMES, float64(*FPS), startTime)
+
+	writeFile(*TIMELINE_FN, func(file *os.File) error {
+		return png.Encode(file, opc.MakeTimelineImage(frames, *SCALE))
+	})
+}